@@ -2,10 +2,24 @@
 package oauth1
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
+	"hash"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // Token contains an end-user's tokens.
@@ -70,6 +84,63 @@ type Token struct {
 	Secret string
 }
 
+// String implements fmt.Stringer. The secret is redacted so that a Token
+// may be logged safely.
+func (t Token) String() string {
+	return "Token{key=" + t.Key + ", secret=REDACTED}"
+}
+
+// GoString implements fmt.GoStringer so that the secret is also redacted
+// when formatted with the %#v verb.
+func (t Token) GoString() string {
+	return "oauth1.Token{Key:" + strconv.Quote(t.Key) + ", Secret:REDACTED}"
+}
+
+// ParsePIN returns the verifier entered by a user in an out-of-band flow
+// with any surrounding whitespace removed, such as a trailing newline read
+// from a terminal. The PIN must be non-empty and must not contain
+// whitespace or control characters.
+func ParsePIN(s string) (string, error) {
+	pin := strings.TrimSpace(s)
+	if pin == "" {
+		return "", ErrMalformedPIN
+	}
+
+	for _, r := range pin {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", ErrMalformedPIN
+		}
+	}
+
+	return pin, nil
+}
+
+// ParseCredential splits a credential stored in the form token:secret into
+// its token and secret. The string is split on the first colon and both
+// parts must be non-empty.
+func ParseCredential(s string) (token, secret string, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", ErrMalformedCredential
+	}
+
+	return s[:i], s[i+1:], nil
+}
+
+// Clock provides the current time. It may be replaced to control the
+// timestamps used by a Transport, such as with a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock used when none is configured.
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 // Transport implements http.RoundTripper. When configured, it can be
 // used to make authenticated HTTP requests.
 type Transport struct {
@@ -98,6 +169,82 @@ type Transport struct {
 	// credentials using the set of temporary credentials.
 	TokenRequestURI string
 
+	// SignatureMethod is the method used to sign requests. It may be
+	// HMAC-SHA1, RSA-SHA1 or PLAINTEXT and defaults to HMAC-SHA1 if empty.
+	// The method may be selected for a single request using Sign.
+	SignatureMethod string
+
+	// PrivateKey is the RSA private key used to sign requests with the
+	// RSA-SHA1 signature method. The Secret is not used by this method. It
+	// is usually an *rsa.PrivateKey, but may be any crypto.Signer with an
+	// RSA public key, such as a key held by a hardware token or a key
+	// management service.
+	PrivateKey crypto.Signer
+
+	// SignatureEncoding, if not nil, encodes the HMAC-SHA1 signature in
+	// place of the standard base64 encoding required by RFC 5849 Section
+	// 3.4.2. It exists only for providers that mistakenly expect another
+	// encoding, such as base64.URLEncoding, and should not otherwise be set.
+	SignatureEncoding *base64.Encoding
+
+	// Signer, if not nil, computes the signature of each base string in
+	// place of the Secret or PrivateKey, such as by delegating to a hardware
+	// security module. The SignatureMethod is sent as the method name and
+	// may be any method understood by the server.
+	Signer func(base string) (string, error)
+
+	// BodyHash, if not nil, is used to compute a digest of the body of each
+	// request that is not form encoded. The base64 encoded digest is signed
+	// and sent as the BodyHashParameter, extending the signature to cover
+	// the body. Form encoded bodies are already covered by the signature.
+	BodyHash func() hash.Hash
+
+	// BodyHashParameter is the name of the protocol parameter holding the
+	// body digest. It defaults to oauth_body_hash if empty and must begin
+	// with oauth_ or xoauth_ to be sent in the Authorization header.
+	BodyHashParameter string
+
+	// Realm is sent as the realm parameter of the Authorization header if
+	// not empty. It is not included in the signature.
+	//
+	// See RFC 5849 Section 3.5.1.
+	Realm string
+
+	// EncodeRealm percent-encodes the Realm in the Authorization header. The
+	// examples in RFC 5849 show the realm quoted but not encoded, though
+	// some providers expect it to be encoded.
+	EncodeRealm bool
+
+	// NumericNonce generates nonces consisting only of decimal digits for
+	// servers that reject any other nonce.
+	NumericNonce bool
+
+	// MillisecondTimestamp generates the oauth_timestamp in milliseconds
+	// rather than seconds since the epoch for providers that require it.
+	// This is not conformant with RFC 5849 Section 3.3.
+	MillisecondTimestamp bool
+
+	// ConventionalOrder lists the parameters of the Authorization header in
+	// the order commonly used by other implementations, starting with
+	// oauth_consumer_key and ending with oauth_signature, rather than sorted
+	// by name. The order has no effect on the signature.
+	ConventionalOrder bool
+
+	// Clock provides the time used for the oauth_timestamp and nonce, and
+	// the expiry of the HeaderCache. It defaults to the system clock if nil.
+	Clock Clock
+
+	// ClockSkew is added to the time of the Clock when generating the
+	// oauth_timestamp. It may be set to the difference between the time of
+	// the server, such as from the Date header of a prior response, and the
+	// local time to correct for a local clock that has drifted.
+	ClockSkew time.Duration
+
+	// OnNonce, if not nil, is called with each nonce generated when signing
+	// a request and the oauth_timestamp it is sent with, such as to record
+	// the nonces used by processes that share credentials.
+	OnNonce func(nonce, timestamp string)
+
 	// Token contains an end-user's tokens.
 	// This may be a set of temporary credentials.
 	Token *Token
@@ -106,8 +253,92 @@ type Transport struct {
 	// It will default to http.DefaultTransport if nil.
 	// It should never be an oauth1.Transport.
 	Transport http.RoundTripper
+
+	// Normalization configures deviations from RFC 5849 made when
+	// constructing the signature base string.
+	Normalization Normalization
+
+	// BaseStringHook, if not nil, is called with the signature base string
+	// and returns the base string to be signed in its place. It exists only
+	// to work around providers that deviate from RFC 5849 and should not
+	// otherwise be used.
+	BaseStringHook func(base string) string
+
+	// Timeout limits the time taken to obtain temporary credentials and
+	// token credentials. A Timeout of zero means no timeout.
+	Timeout time.Duration
+
+	// UserAgent is sent with the requests made to obtain temporary
+	// credentials and token credentials. It defaults to a value identifying
+	// this package if empty.
+	UserAgent string
+
+	// RequestID, if not nil, is called for each request made by RoundTrip
+	// that does not already have an X-Request-Id header. The result is sent
+	// as the X-Request-Id header, which is not part of the signature.
+	RequestID func() string
+
+	// Retries is the number of times RoundTrip re-signs and retries a
+	// request with a fresh nonce and timestamp after the server reports the
+	// nonce as used or the timestamp as refused.
+	Retries int
+
+	// HeaderCache, if not nil, caches the signed Authorization header of
+	// each request signed by the Transport, whether by RoundTrip, NewRequest,
+	// Sign or any other method that signs a request, so that identical
+	// requests made within the cache TTL reuse the header rather than being
+	// signed again. The requests made to obtain temporary credentials and
+	// token credentials are always signed. See HeaderCache for the reduced
+	// replay protection.
+	HeaderCache *HeaderCache
+
+	// DryRun, if not nil, is called by RoundTrip with each signed request and
+	// its signature base string in place of sending the request. RoundTrip
+	// then returns an empty 200 OK response. This is intended for inspecting
+	// the signing of requests without contacting the server.
+	DryRun func(req *http.Request, base string)
+
+	// SetDate sets the Date header of each request to the time of its
+	// oauth_timestamp for servers that require the header to agree with the
+	// timestamp. The Date header is not signed, nor set for a request whose
+	// oauth_timestamp is omitted.
+	SetDate bool
+
+	// AssumeForm sets the Content-Type of requests that have a body but no
+	// Content-Type to application/x-www-form-urlencoded so that the body
+	// parameters are signed. Otherwise the body of these requests is not
+	// part of the signature.
+	AssumeForm bool
+
+	// RequireContentType rejects requests that have a body but no
+	// Content-Type with ErrMissingContentType, since any body parameters
+	// would silently be left out of the signature. A body of unknown length
+	// is not read to tell whether it is empty. It has no effect if
+	// AssumeForm is set.
+	RequireContentType bool
 }
 
+var (
+	ErrMissingContentType  = errors.New("request with body is missing Content-Type")
+	ErrMalformedCredential = errors.New("credential is not of the form token:secret")
+	ErrMalformedPIN        = errors.New("malformed PIN")
+	ErrMissingSecret       = errors.New("signature method requires a Secret")
+	ErrMissingRSAKey       = errors.New("signature method requires a PrivateKey")
+)
+
+// OutOfBand is the CallbackURI of clients that are unable to receive a
+// callback. The server displays the verifier to the resource owner, who
+// enters it in the client, often as a short PIN.
+//
+// See RFC 5849 Section 2.1.
+const OutOfBand = "oob"
+
+// Version is the version of this package. It is sent in the default
+// User-Agent.
+const Version = "0.1.0"
+
+const defaultUserAgent = "oauth1/" + Version + " (+https://github.com/pnelson/oauth1)"
+
 var (
 	errResponseToken       = errors.New("missing oauth_token")
 	errResponseTokenSecret = errors.New("missing oauth_token_secret")
@@ -118,6 +349,17 @@ func (t *Transport) Client() *http.Client {
 	return &http.Client{Transport: t}
 }
 
+// WithToken returns a copy of the Transport that signs requests with the
+// token in place of its own, such as a token delegated to the consumer on
+// behalf of another user. The Transport is not modified. The copy shares
+// any HeaderCache, which distinguishes tokens by their key.
+func (t *Transport) WithToken(token *Token) *Transport {
+	c := *t
+	c.Token = token
+
+	return &c
+}
+
 // RequestTemporaryCredentials obtains a set of temporary credentials by making
 // an authenticated request to the Temporary Credential Request endpoint. The
 // AuthorizationURI configured with the required oauth_token query parameter
@@ -125,7 +367,23 @@ func (t *Transport) Client() *http.Client {
 //
 // See RFC 5849 Section 2.1 and 2.2.
 func (t *Transport) RequestTemporaryCredentials() (string, error) {
-	params := url.Values{"oauth_callback": {t.CallbackURI}}
+	return t.requestTemporaryCredentials(t.CallbackURI)
+}
+
+// RequestOutOfBandCredentials is like RequestTemporaryCredentials but uses
+// the OutOfBand callback in place of the CallbackURI. After the resource
+// owner visits the returned URI, the server displays a PIN that should be
+// passed through ParsePIN and then used as the verifier for RequestToken.
+//
+// See RFC 5849 Section 2.1.
+func (t *Transport) RequestOutOfBandCredentials() (string, error) {
+	return t.requestTemporaryCredentials(OutOfBand)
+}
+
+// requestTemporaryCredentials obtains a set of temporary credentials using
+// the callback and returns the authorization URI.
+func (t *Transport) requestTemporaryCredentials(callback string) (string, error) {
+	params := url.Values{"oauth_callback": {callback}}
 	_, err := t.request(t.TemporaryCredentialsURI, params)
 	if err != nil {
 		return "", err
@@ -152,67 +410,618 @@ func (t *Transport) RequestToken(verifier string) (url.Values, error) {
 	return t.request(t.TokenRequestURI, params)
 }
 
+// NewRequest returns a new request signed with the Transport's Token. The
+// request is ready to be sent with any http.Client.
+//
+// The method is uppercased. If a body encoded as
+// application/x-www-form-urlencoded is provided for a method that permits
+// one, the Content-Type is set accordingly so that the body parameters are
+// included in the signature. Requests with other content types should be
+// constructed manually and sent using the Client.
+func (t *Transport) NewRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil && hasBody(req.Method) {
+		b, err := readBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if isFormBody(b) {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+
+	err = t.sign(req, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// SignedForm returns the Authorization header and encoded body for a form
+// POST to rawurl. The signature covers the form values. This is useful when
+// the request is to be sent by some other HTTP client, which must also set
+// the Content-Type to application/x-www-form-urlencoded.
+func (t *Transport) SignedForm(rawurl string, form url.Values) (header string, body string, err error) {
+	body = form.Encode()
+	req, err := http.NewRequest("POST", rawurl, strings.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = t.sign(req, url.Values{})
+	if err != nil {
+		return "", "", err
+	}
+
+	return req.Header.Get("Authorization"), body, nil
+}
+
 // RoundTrip executes a single HTTP transaction using the Transport's Token as
 // authorization headers.
 //
 // See RFC 5849 Section 3.1.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Build the Authorization header.
-	header, err := t.authenticate(req, url.Values{})
+	// This is so that we don't modify the original request as specified
+	// in the documentation for http.RoundTripper.
+	req = cloneRequest(req)
+
+	// Headers other than Authorization are not signed.
+	if t.RequestID != nil && req.Header.Get("X-Request-Id") == "" {
+		req.Header.Set("X-Request-Id", t.RequestID())
+	}
+
+	// Buffer the body so that it may be sent again if the request is
+	// retried. Otherwise it is only buffered if it is signed.
+	var body []byte
+	if t.Retries > 0 {
+		var err error
+		body, err = readBody(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for retries := 0; ; retries++ {
+		r := cloneRequest(req)
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		// Build the Authorization header.
+		key, err := t.signCached(r, url.Values{})
+		if err != nil {
+			return nil, err
+		}
+
+		if t.DryRun != nil {
+			return t.dryRun(r)
+		}
+
+		// Make the HTTP request.
+		response, err := t.transport().RoundTrip(r)
+		if err != nil || retries >= t.Retries || !nonceRejected(response) {
+			return response, err
+		}
+
+		// The retry must not reuse the rejected header.
+		if t.HeaderCache != nil {
+			t.HeaderCache.remove(key)
+		}
+
+		response.Body.Close()
+	}
+}
+
+// dryRun passes the signed request and its signature base string to DryRun
+// and returns an empty response in place of sending the request.
+func (t *Transport) dryRun(req *http.Request) (*http.Response, error) {
+	base, err := signatureBase(req, nil, &t.Normalization)
 	if err != nil {
 		return nil, err
 	}
 
-	// This is so that we don't modify the original request as specified
-	// in the documentation for http.RoundTripper.
-	req = cloneRequest(req)
+	if t.BaseStringHook != nil {
+		base = t.BaseStringHook(base)
+	}
+
+	t.DryRun(req, base)
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// Sign sets the Authorization header on the request using the Transport's
+// Token. Unlike RoundTrip, the request is modified in place.
+//
+// Additional protocol parameters to be signed may be provided in params.
+// These take precedence over the values the Transport would otherwise use,
+// so that an oauth_timestamp provided in params is used in place of the
+// current time, an oauth_nonce in place of a generated nonce, a realm in
+// place of the Realm and so on. A parameter provided without a value or with
+// an empty value is omitted, such as an empty oauth_version for a server that
+// rejects it, whether or not the Transport would otherwise send it. The
+// Transport is not modified.
+//
+// See RFC 5849 Section 3.1.
+func (t *Transport) Sign(req *http.Request, params url.Values) error {
+	extra := url.Values{}
+	for k, vs := range params {
+		extra[k] = append([]string(nil), vs...)
+	}
+
+	return t.sign(req, extra)
+}
+
+// SignMap replaces the body of the request with the form encoded from the
+// map, sets the Content-Type to application/x-www-form-urlencoded and signs
+// it as for Sign. It is a convenience for forms with a single value for
+// each field.
+func (t *Transport) SignMap(req *http.Request, form map[string]string) error {
+	values := make(url.Values, len(form))
+	for k, v := range form {
+		values.Set(k, v)
+	}
+
+	body := values.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return t.sign(req, url.Values{})
+}
+
+// SignWithTimeout returns a copy of the request signed with the Transport's
+// Token and carrying a context that is canceled after the timeout d. The
+// returned cancel function should be called to release the context once the
+// request has completed. The original request is not modified.
+func (t *Transport) SignWithTimeout(req *http.Request, d time.Duration) (*http.Request, context.CancelFunc, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	r := cloneRequest(req).WithContext(ctx)
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	err = t.sign(r, url.Values{})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return r, cancel, nil
+}
+
+// FixedAuthorizationHeader returns the Authorization header for the request
+// signed with the given nonce and timestamp in place of generated values.
+// The header is the same for the same request and credentials, which is
+// useful for comparing against a known header in tests. The request is not
+// modified.
+//
+// A fixed nonce must never be used for requests that are sent to a server.
+func (t *Transport) FixedAuthorizationHeader(req *http.Request, nonce, timestamp string) (string, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+
+	r := cloneRequest(req)
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	err = t.sign(r, url.Values{"oauth_nonce": {nonce}, "oauth_timestamp": {timestamp}})
+	if err != nil {
+		return "", err
+	}
+
+	return r.Header.Get("Authorization"), nil
+}
+
+// CurlCommand returns a curl command that sends the request signed with the
+// Transport's Token, which is useful for reproducing a request outside of
+// the program. The command includes the headers and body of the request
+// but not the credentials, except for the PLAINTEXT signature method where
+// the signature is made from the secrets. The request is not modified.
+func (t *Transport) CurlCommand(req *http.Request) (string, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+
+	r := cloneRequest(req)
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	err = t.sign(r, url.Values{})
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	args := []string{"curl", "-X", shellQuote(r.Method)}
+	for _, k := range keys {
+		for _, v := range r.Header[k] {
+			args = append(args, "-H", shellQuote(k+": "+v))
+		}
+	}
+
+	if len(body) > 0 {
+		args = append(args, "--data-raw", shellQuote(string(body)))
+	}
+
+	args = append(args, shellQuote(r.URL.String()))
+
+	return strings.Join(args, " "), nil
+}
+
+// shellQuote returns s quoted for a POSIX shell. Strings of only safe
+// characters are returned unquoted.
+func shellQuote(s string) string {
+	safe := s != ""
+	for i := 0; i < len(s) && safe; i++ {
+		c := s[i]
+		safe = 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.,:/@%+=", c) >= 0
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// sign sets the Authorization header on the request. A body that is signed,
+// either as a form or by the BodyHash, is buffered so that it remains
+// readable after the parameters have been collected. Other bodies are left
+// unread so that they may be streamed.
+func (t *Transport) sign(req *http.Request, params url.Values) error {
+	_, err := t.signCached(req, params)
+
+	return err
+}
+
+// signCached is like sign but also returns the HeaderCache key of the
+// request, which is empty if there is no HeaderCache. The key is computed
+// after the body hash has been added and the Content-Type assumed.
+func (t *Transport) signCached(req *http.Request, params url.Values) (string, error) {
+	contentType := req.Header.Get("Content-Type")
+	hasContent := req.Body != nil && req.Body != http.NoBody
+	if contentType == "" && hasContent && t.RequireContentType && !t.AssumeForm {
+		return "", ErrMissingContentType
+	}
+
+	// A body assumed to be a form must be read to tell whether it is empty.
+	assumeForm := contentType == "" && t.AssumeForm
+	var body []byte
+	var err error
+	if t.BodyHash != nil || assumeForm || isForm(req.Header) {
+		body, err = readBody(req)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(body) > 0 && assumeForm {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if t.BodyHash != nil && !isForm(req.Header) {
+		name := t.bodyHashParameter()
+		if params.Get(name) == "" {
+			h := t.BodyHash()
+			h.Write(body)
+			params.Set(name, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		}
+	}
+
+	key := ""
+	header, ok := "", false
+	if t.HeaderCache != nil {
+		key = t.headerCacheKey(req, body, params)
+		header, ok = t.HeaderCache.get(key, t.now())
+	}
+
+	if !ok {
+		header, err = t.authenticate(req, params)
+		if err != nil {
+			return "", err
+		}
+
+		if t.HeaderCache != nil {
+			t.HeaderCache.put(key, header, t.now())
+		}
+	}
+
+	// GetBody allows the body to be sent again when a redirect is followed.
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
 	req.Header.Set("Authorization", header)
+	if t.SetDate {
+		setDate(req, t.MillisecondTimestamp)
+	}
+
+	return key, nil
+}
 
-	// Make the HTTP request.
-	return t.transport().RoundTrip(req)
+// headerCacheKey returns the HeaderCache key identifying the request and
+// the credentials used to sign it.
+func (t *Transport) headerCacheKey(req *http.Request, body []byte, params url.Values) string {
+	token := ""
+	if t.Token != nil {
+		token = t.Token.Key
+	}
+
+	return strings.Join([]string{
+		t.Key,
+		token,
+		t.signatureMethod(),
+		req.Method,
+		req.URL.String(),
+		req.Header.Get("Content-Type"),
+		params.Encode(),
+		string(body),
+	}, "\n")
 }
 
 // authenticate returns a signed Authorization header for the given request.
 //
 // See RFC 5849 Section 3.1.
 func (t *Transport) authenticate(req *http.Request, params url.Values) (string, error) {
-	nonce, err := generateNonce()
-	if err != nil {
-		return "", err
+	// Authenticated requests include several protocol parameters. Those
+	// provided in params take precedence over the defaults, and are omitted
+	// if provided without a value.
+	provided := make(map[string]bool, len(params))
+	for k := range params {
+		provided[k] = true
 	}
 
-	// Authenticated requests include several protocol parameters.
-	params.Add("oauth_consumer_key", t.Key)
-	params.Add("oauth_signature_method", "HMAC-SHA1")
-	params.Add("oauth_timestamp", generateTimestamp())
-	params.Add("oauth_nonce", nonce)
-	params.Add("oauth_version", "1.0")
+	removeEmpty(params)
+	if !provided["oauth_consumer_key"] {
+		params.Set("oauth_consumer_key", t.Key)
+	}
+	if !provided["oauth_signature_method"] {
+		params.Set("oauth_signature_method", t.signatureMethod())
+	}
+	if !provided["oauth_timestamp"] {
+		params.Set("oauth_timestamp", t.timestamp())
+	}
+	if !provided["oauth_nonce"] {
+		nonce, err := t.nonce()
+		if err != nil {
+			return "", err
+		}
+
+		params.Set("oauth_nonce", nonce)
+		if t.OnNonce != nil {
+			t.OnNonce(nonce, params.Get("oauth_timestamp"))
+		}
+	}
+	if !provided["oauth_version"] {
+		params.Set("oauth_version", "1.0")
+	}
 
 	// Add the token, if present.
-	if t.Token != nil {
+	if !provided["oauth_token"] && t.Token != nil {
 		params.Set("oauth_token", t.Token.Key)
 	}
 
-	// Build the HMAC key.
-	key := encode(t.Secret) + "&"
-	if t.Token != nil {
-		key += encode(t.Token.Secret)
+	// The realm is not signed unless the Normalization requires it.
+	realm := t.Realm
+	if provided["realm"] {
+		realm = params.Get("realm")
+		params.Del("realm")
+	}
+
+	if realm != "" && t.Normalization.SignRealm {
+		params.Set("realm", realm)
 	}
 
 	// Build the Authorization header.
-	header, err := authenticate(req, params, key)
+	method := params.Get("oauth_signature_method")
+	header, err := authenticate(req, params, &t.Normalization, t.ConventionalOrder, func(base string) (string, error) {
+		if t.BaseStringHook != nil {
+			base = t.BaseStringHook(base)
+		}
+
+		if t.Signer != nil {
+			return t.Signer(base)
+		}
+
+		return t.signature(method, base)
+	})
 	if err != nil {
 		return "", err
 	}
 
+	if realm != "" {
+		header = addRealm(header, realm, t.EncodeRealm)
+	}
+
 	return header, nil
 }
 
+// removeEmpty deletes the empty values from params and the parameters that
+// are left without a value, so that they are omitted from the request.
+func removeEmpty(params url.Values) {
+	for k, vs := range params {
+		values := vs[:0]
+		for _, v := range vs {
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+
+		if len(values) == 0 {
+			delete(params, k)
+			continue
+		}
+
+		params[k] = values
+	}
+}
+
+// signature returns the signature of the base string using the credentials
+// for the signature method.
+//
+// See RFC 5849 Section 3.4.
+func (t *Transport) signature(method, base string) (string, error) {
+	switch method {
+	case "HMAC-SHA1", "PLAINTEXT":
+		if t.Secret == "" {
+			return "", ErrMissingSecret
+		}
+	case "RSA-SHA1":
+		if t.PrivateKey == nil {
+			return "", ErrMissingRSAKey
+		}
+
+		if _, ok := t.PrivateKey.Public().(*rsa.PublicKey); !ok {
+			return "", ErrMissingRSAKey
+		}
+	}
+
+	switch method {
+	case "HMAC-SHA1":
+		if t.SignatureEncoding != nil {
+			b, err := sumHMAC(sha1.New, base, t.key())
+			if err != nil {
+				return "", err
+			}
+
+			return t.SignatureEncoding.EncodeToString(b), nil
+		}
+
+		return sign(base, t.key())
+	case "RSA-SHA1":
+		return signRSA(base, t.PrivateKey)
+	case "PLAINTEXT":
+		return t.key(), nil
+	}
+
+	return "", ErrUnsupportedSignatureMethod
+}
+
+// timestamp returns the oauth_timestamp for the current time.
+func (t *Transport) timestamp() string {
+	if t.MillisecondTimestamp {
+		return generateMillisecondTimestamp(t.now())
+	}
+
+	return generateTimestamp(t.now())
+}
+
+// nonce returns a nonce of the configured form.
+func (t *Transport) nonce() (string, error) {
+	if t.NumericNonce {
+		return generateNumericNonce(t.now())
+	}
+
+	return generateNonce(t.now())
+}
+
+// now returns the current time from the configured Clock adjusted by the
+// ClockSkew.
+func (t *Transport) now() time.Time {
+	if t.Clock != nil {
+		return t.Clock.Now().Add(t.ClockSkew)
+	}
+
+	return realClock{}.Now().Add(t.ClockSkew)
+}
+
+// bodyHashParameter returns the configured BodyHashParameter, or
+// oauth_body_hash.
+func (t *Transport) bodyHashParameter() string {
+	if t.BodyHashParameter != "" {
+		return t.BodyHashParameter
+	}
+
+	return "oauth_body_hash"
+}
+
+// signatureMethod returns the configured SignatureMethod, or HMAC-SHA1.
+func (t *Transport) signatureMethod() string {
+	if t.SignatureMethod != "" {
+		return t.SignatureMethod
+	}
+
+	return "HMAC-SHA1"
+}
+
+// NormalizedSignature returns the signature for the request computed with
+// normalized in place of the parameters that would otherwise be collected
+// from the request. The normalized string must already be sorted and encoded
+// as described in RFC 5849 Section 3.4.1.3.2.
+//
+// This is intended for reproducing the exact signature base string computed
+// by a provider when debugging a signature mismatch. Most users should never
+// need to call it.
+func (t *Transport) NormalizedSignature(req *http.Request, normalized string) (string, error) {
+	uri, err := baseStringURI(req, &t.Normalization)
+	if err != nil {
+		return "", err
+	}
+
+	base := joinNormalizedBase(req.Method, uri, normalized)
+
+	return t.signature(t.signatureMethod(), base)
+}
+
+// key returns the HMAC key built from the consumer and token secrets.
+//
+// See RFC 5849 Section 3.4.2.
+func (t *Transport) key() string {
+	key := encode(t.Secret) + "&"
+	if t.Token != nil {
+		key += encode(t.Token.Secret)
+	}
+
+	return key
+}
+
 // request makes an HTTP POST request to the uri with some extra OAuth
 // parameters. The Transport Token is updated from the response.
 func (t *Transport) request(uri string, params url.Values) (url.Values, error) {
+	ctx := context.Background()
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
 	c := &http.Client{Transport: t.transport()}
-	req, err := http.NewRequest("POST", uri, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -223,6 +1032,11 @@ func (t *Transport) request(uri string, params url.Values) (url.Values, error) {
 	}
 
 	req.Header.Set("Authorization", header)
+	req.Header.Set("User-Agent", t.userAgent())
+	if t.SetDate {
+		setDate(req, t.MillisecondTimestamp)
+	}
+
 	response, err := c.Do(req)
 	if err != nil {
 		return nil, err
@@ -239,7 +1053,7 @@ func (t *Transport) request(uri string, params url.Values) (url.Values, error) {
 		return nil, err
 	}
 
-	form, err := url.ParseQuery(string(body))
+	form, err := parseTokenResponse(body)
 	if err != nil {
 		return nil, err
 	}
@@ -262,6 +1076,25 @@ func (t *Transport) request(uri string, params url.Values) (url.Values, error) {
 	return form, nil
 }
 
+// parseTokenResponse parses the form encoded body of a response containing
+// credentials. A leading UTF-8 byte order mark and surrounding whitespace,
+// which some providers include, are removed first.
+//
+// See RFC 5849 Section 2.1 and 2.3.
+func parseTokenResponse(body []byte) (url.Values, error) {
+	s := strings.TrimPrefix(string(body), "\ufeff")
+	return url.ParseQuery(strings.TrimSpace(s))
+}
+
+// userAgent returns the configured UserAgent, or the default.
+func (t *Transport) userAgent() string {
+	if t.UserAgent != "" {
+		return t.UserAgent
+	}
+
+	return defaultUserAgent
+}
+
 // transport returns the configured Transport, or the http.DefaultTransport.
 func (t *Transport) transport() http.RoundTripper {
 	if t.Transport != nil {
@@ -271,6 +1104,174 @@ func (t *Transport) transport() http.RoundTripper {
 	return http.DefaultTransport
 }
 
+// HeaderCache caches signed Authorization headers for a short time. It is
+// keyed by the credentials, method, URL, extra protocol parameters and body
+// of a request. It is safe for concurrent use.
+//
+// A cached header reuses the nonce and timestamp of the original request,
+// which weakens the replay protection they provide. Servers that track used
+// nonces will reject the repeated requests, so caching should only be used
+// for idempotent requests to servers known to accept them.
+type HeaderCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	headers map[string]cachedHeader
+}
+
+// cachedHeader is a signed Authorization header and its expiry.
+type cachedHeader struct {
+	header  string
+	expires time.Time
+}
+
+// NewHeaderCache returns a HeaderCache that retains headers for ttl.
+func NewHeaderCache(ttl time.Duration) *HeaderCache {
+	return &HeaderCache{
+		ttl:     ttl,
+		headers: make(map[string]cachedHeader),
+	}
+}
+
+// get returns the cached header for key if it has not expired by now.
+func (c *HeaderCache) get(key string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.headers[key]
+	if !ok {
+		return "", false
+	}
+
+	if !now.Before(h.expires) {
+		delete(c.headers, key)
+		return "", false
+	}
+
+	return h.header, true
+}
+
+// put caches the header for key from now. Expired headers are removed so
+// that the cache does not grow without bound.
+func (c *HeaderCache) put(key, header string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, h := range c.headers {
+		if !now.Before(h.expires) {
+			delete(c.headers, k)
+		}
+	}
+
+	c.headers[key] = cachedHeader{header: header, expires: now.Add(c.ttl)}
+}
+
+// remove discards the cached header for key.
+func (c *HeaderCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.headers, key)
+}
+
+// nonceRejected returns true if the response reports that the nonce or
+// timestamp of the request was refused using the oauth_problem parameter
+// in either the WWW-Authenticate header or the body. The response body is
+// restored so that it may be read again.
+func nonceRejected(response *http.Response) bool {
+	if response.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	problem := response.Header.Get("WWW-Authenticate") + " " + string(body)
+
+	return strings.Contains(problem, "oauth_problem=nonce_used") ||
+		strings.Contains(problem, "oauth_problem=timestamp_refused")
+}
+
+// setDate sets the Date header of the signed request to the time of its
+// oauth_timestamp, which is in milliseconds if millisecond is true. The Date
+// header is not set if the oauth_timestamp was omitted or is not a number.
+func setDate(req *http.Request, millisecond bool) {
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		return
+	}
+
+	n, err := strconv.ParseInt(params.Get("oauth_timestamp"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	date := time.Unix(n, 0)
+	if millisecond {
+		date = time.Unix(0, n*int64(time.Millisecond))
+	}
+
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+}
+
+// readBody reads and returns the request body, replacing it with a reader
+// over the same bytes. A nil slice is returned if the request has no body.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// hasBody returns true if the HTTP method permits a form body.
+func hasBody(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+
+	return false
+}
+
+// isFormBody returns true if the body is a non-empty sequence of name=value
+// pairs encoded as application/x-www-form-urlencoded.
+func isFormBody(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+
+	for _, pair := range strings.Split(string(body), "&") {
+		if strings.IndexByte(pair, '=') <= 0 {
+			return false
+		}
+
+		for i := 0; i < len(pair); i++ {
+			c := pair[i]
+			if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~*%+=", c) >= 0) {
+				return false
+			}
+		}
+
+		if _, err := url.QueryUnescape(pair); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 // cloneRequest returns a copy of the given request.
 func cloneRequest(r *http.Request) *http.Request {
 	// shallow copy of the struct
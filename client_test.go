@@ -0,0 +1,1935 @@
+package oauth1
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCredential(t *testing.T) {
+	var tests = []struct {
+		// in
+		in string
+
+		// out
+		token  string
+		secret string
+		err    error
+	}{
+		{"nnch734d00sl2jdk:pfkkdhi9sl3r4s00", "nnch734d00sl2jdk", "pfkkdhi9sl3r4s00", nil},
+		{"nnch734d00sl2jdk:pfkk:dhi9", "nnch734d00sl2jdk", "pfkk:dhi9", nil},
+		{"nnch734d00sl2jdk", "", "", ErrMalformedCredential},
+		{":pfkkdhi9sl3r4s00", "", "", ErrMalformedCredential},
+		{"nnch734d00sl2jdk:", "", "", ErrMalformedCredential},
+		{"", "", "", ErrMalformedCredential},
+	}
+
+	for i, tt := range tests {
+		token, secret, err := ParseCredential(tt.in)
+		if err != tt.err {
+			t.Errorf("%d. ParseCredential %q\nhave %v\nwant %v", i, tt.in, err, tt.err)
+		}
+
+		if token != tt.token || secret != tt.secret {
+			t.Errorf("%d. ParseCredential %q\nhave %s %s\nwant %s %s", i, tt.in, token, secret, tt.token, tt.secret)
+		}
+	}
+}
+
+func TestParsePIN(t *testing.T) {
+	var tests = []struct {
+		// in
+		in string
+
+		// out
+		out string
+		err error
+	}{
+		{"4821306", "4821306", nil},
+		{"  4821306\n", "4821306", nil},
+		{"\t4821306\r\n", "4821306", nil},
+		{"4821 306", "", ErrMalformedPIN},
+		{" \n", "", ErrMalformedPIN},
+		{"", "", ErrMalformedPIN},
+	}
+
+	for i, tt := range tests {
+		out, err := ParsePIN(tt.in)
+		if err != tt.err {
+			t.Errorf("%d. ParsePIN %q\nhave %v\nwant %v", i, tt.in, err, tt.err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. ParsePIN %q\nhave %s\nwant %s", i, tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestRequestOutOfBandCredentials(t *testing.T) {
+	var callback string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values, err := parseAuthorizationHeader(r, nil)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+
+		callback = values.Get("oauth_callback")
+		w.Write([]byte("oauth_token=hh5s93j4hdidpola&oauth_token_secret=hdhd0244k9j7ao03"))
+	}))
+	defer ts.Close()
+
+	tr := &Transport{
+		Key:                     "dpf43f3p2l4k3l03",
+		Secret:                  "kd94hf93k423kf44",
+		CallbackURI:             "http://printer.example.com/ready",
+		TemporaryCredentialsURI: ts.URL,
+		AuthorizationURI:        "https://photos.example.net/authorize",
+	}
+
+	uri, err := tr.RequestOutOfBandCredentials()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if callback != OutOfBand {
+		t.Errorf("oauth_callback\nhave %s\nwant %s", callback, OutOfBand)
+	}
+
+	expected := "https://photos.example.net/authorize?oauth_token=hh5s93j4hdidpola"
+	if uri != expected {
+		t.Errorf("authorization URI\nhave %s\nwant %s", uri, expected)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	tr := &Transport{
+		Key:    "dpf43f3p2l4k3l03",
+		Secret: "kd94hf93k423kf44",
+		Token: &Token{
+			Key:    "nnch734d00sl2jdk",
+			Secret: "pfkkdhi9sl3r4s00",
+		},
+	}
+
+	uri := "http://photos.example.net/photos?size=original"
+	body := strings.NewReader("file=vacation.jpg")
+	req, err := tr.NewRequest(context.Background(), "POST", uri, body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := req.Header.Get("Content-Type"); v != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type\nhave %s\nwant %s", v, "application/x-www-form-urlencoded")
+	}
+
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := params.Get("oauth_token"); v != "nnch734d00sl2jdk" {
+		t.Errorf("oauth_token\nhave %s\nwant %s", v, "nnch734d00sl2jdk")
+	}
+
+	base, err := signatureBase(req, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !strings.Contains(base, "file%3Dvacation.jpg") {
+		t.Errorf("body parameters should be signed\nhave %s", base)
+	}
+
+	expected, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v, _ := url.PathUnescape(params.Get("oauth_signature")); v != expected {
+		t.Errorf("oauth_signature\nhave %s\nwant %s", v, expected)
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if string(b) != "file=vacation.jpg" {
+		t.Errorf("body\nhave %s\nwant %s", b, "file=vacation.jpg")
+	}
+}
+
+func TestNewRequestContentType(t *testing.T) {
+	var tests = []struct {
+		// in
+		method string
+		body   string
+
+		// out
+		contentType string
+	}{
+		{"POST", "file=vacation.jpg", "application/x-www-form-urlencoded"},
+		{"post", "file=vacation.jpg&size=", "application/x-www-form-urlencoded"},
+		{"patch", "title=Sunset+at+sea%21", "application/x-www-form-urlencoded"},
+		{"POST", `{"title":"Sunset"}`, ""},
+		{"PUT", "vacation photos", ""},
+		{"POST", "=vacation.jpg", ""},
+		{"DELETE", "file=vacation.jpg", ""},
+		{"get", "file=vacation.jpg", ""},
+	}
+
+	tr := &Transport{
+		Key:    "dpf43f3p2l4k3l03",
+		Secret: "kd94hf93k423kf44",
+	}
+
+	for i, tt := range tests {
+		req, err := tr.NewRequest(context.Background(), tt.method, "http://photos.example.net/photos", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if req.Method != strings.ToUpper(tt.method) {
+			t.Errorf("%d. Method\nhave %s\nwant %s", i, req.Method, strings.ToUpper(tt.method))
+		}
+
+		if v := req.Header.Get("Content-Type"); v != tt.contentType {
+			t.Errorf("%d. Content-Type\nhave %s\nwant %s", i, v, tt.contentType)
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestRoundTripStreamsBody(t *testing.T) {
+	var tests = []struct {
+		// in
+		contentType string
+		bodyHash    bool
+		retries     int
+
+		// out
+		streamed bool
+	}{
+		{"application/octet-stream", false, 0, true},
+		{"", false, 0, true},
+		{"application/x-www-form-urlencoded", false, 0, false},
+		{"application/x-www-form-urlencoded; charset=utf-8", false, 0, false},
+		{"application/octet-stream", true, 0, false},
+		{"application/octet-stream", false, 1, false},
+	}
+
+	for i, tt := range tests {
+		body := ioutil.NopCloser(strings.NewReader("file=vacation.jpg"))
+		req, err := http.NewRequest("PUT", "http://photos.example.net/photos", body)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", tt.contentType)
+
+		var sent *http.Request
+		tr := *testTransport
+		tr.Retries = tt.retries
+		if tt.bodyHash {
+			tr.BodyHash = sha1.New
+		}
+
+		tr.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		})
+
+		_, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if streamed := sent.Body == body; streamed != tt.streamed {
+			t.Errorf("%d. streamed\nhave %v\nwant %v", i, streamed, tt.streamed)
+		}
+
+		err = testVerifier.Verify(sent)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+
+		b, err := ioutil.ReadAll(sent.Body)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if string(b) != "file=vacation.jpg" {
+			t.Errorf("%d. body\nhave %s\nwant %s", i, b, "file=vacation.jpg")
+		}
+	}
+}
+
+func TestNormalizedSignature(t *testing.T) {
+	tr := &Transport{
+		Key:    "dpf43f3p2l4k3l03",
+		Secret: "kd94hf93k423kf44",
+		Token: &Token{
+			Key:    "nnch734d00sl2jdk",
+			Secret: "pfkkdhi9sl3r4s00",
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	normalized := "" +
+		"file=vacation.jpg&oauth_consumer_key=dpf43f3p2l4k3l03&oauth_nonce=ch" +
+		"apoH&oauth_signature_method=HMAC-SHA1&oauth_timestamp=137131202&oau" +
+		"th_token=nnch734d00sl2jdk&size=original"
+
+	out, err := tr.NormalizedSignature(req, normalized)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "MdpQcU8iPSUjWoN/UDMsK2sui9I="
+	if out != expected {
+		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
+	}
+}
+
+func TestTokenString(t *testing.T) {
+	token := &Token{
+		Key:    "nnch734d00sl2jdk",
+		Secret: "pfkkdhi9sl3r4s00",
+	}
+
+	for _, format := range []string{"%v", "%s", "%+v", "%#v"} {
+		out := fmt.Sprintf(format, token)
+		if strings.Contains(out, token.Secret) {
+			t.Errorf("%s should redact the secret\nhave %s", format, out)
+		}
+
+		if !strings.Contains(out, token.Key) {
+			t.Errorf("%s should include the key\nhave %s", format, out)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("oauth_token=hh5s93j4hdidpola&oauth_token_secret=hdhd0244k9j7ao03"))
+	}))
+	defer ts.Close()
+
+	tr := &Transport{
+		Key:                     "dpf43f3p2l4k3l03",
+		Secret:                  "kd94hf93k423kf44",
+		TemporaryCredentialsURI: ts.URL,
+		AuthorizationURI:        ts.URL,
+		Timeout:                 10 * time.Millisecond,
+	}
+
+	_, err := tr.RequestTemporaryCredentials()
+	if err == nil {
+		t.Fatalf("expected timeout error")
+	}
+
+	if tr.Token != nil {
+		t.Errorf("token should not be set after a timeout")
+	}
+}
+
+func TestRequestTokenResponse(t *testing.T) {
+	var tests = []struct {
+		// in
+		body string
+
+		// out
+		key    string
+		secret string
+	}{
+		{"oauth_token=nnch734d00sl2jdk&oauth_token_secret=pfkkdhi9sl3r4s00", "nnch734d00sl2jdk", "pfkkdhi9sl3r4s00"},
+		{"\ufeffoauth_token=nnch734d00sl2jdk&oauth_token_secret=pfkkdhi9sl3r4s00", "nnch734d00sl2jdk", "pfkkdhi9sl3r4s00"},
+		{"oauth_token=nnch734d00sl2jdk&oauth_token_secret=pfkkdhi9sl3r4s00\n", "nnch734d00sl2jdk", "pfkkdhi9sl3r4s00"},
+		{"\ufeffoauth_token=nnch734d00sl2jdk&oauth_token_secret=pfkkdhi9sl3r4s00\r\n", "nnch734d00sl2jdk", "pfkkdhi9sl3r4s00"},
+	}
+
+	for i, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.body))
+		}))
+
+		tr := &Transport{
+			Key:             "dpf43f3p2l4k3l03",
+			Secret:          "kd94hf93k423kf44",
+			TokenRequestURI: ts.URL,
+			Token:           &Token{Key: "hh5s93j4hdidpola", Secret: "hdhd0244k9j7ao03"},
+		}
+
+		_, err := tr.RequestToken("hfdp7dh39dks9884")
+		ts.Close()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if tr.Token.Key != tt.key || tr.Token.Secret != tt.secret {
+			t.Errorf("%d. Token\nhave %s %s\nwant %s %s", i, tr.Token.Key, tr.Token.Secret, tt.key, tt.secret)
+		}
+	}
+}
+
+func TestSignTimestamp(t *testing.T) {
+	tr := &Transport{
+		Key:    "dpf43f3p2l4k3l03",
+		Secret: "kd94hf93k423kf44",
+	}
+
+	var tests = []struct {
+		// in
+		timestamp string
+	}{
+		{"137131201"},
+		{""},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := url.Values{}
+		if tt.timestamp != "" {
+			params.Set("oauth_timestamp", tt.timestamp)
+		}
+
+		err = tr.Sign(req, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		timestamp := values.Get("oauth_timestamp")
+		if tt.timestamp != "" && timestamp != tt.timestamp {
+			t.Errorf("%d. oauth_timestamp\nhave %s\nwant %s", i, timestamp, tt.timestamp)
+		}
+
+		if tt.timestamp == "" {
+			n, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil || time.Since(time.Unix(n, 0)) > time.Minute {
+				t.Errorf("%d. oauth_timestamp should be generated\nhave %s", i, timestamp)
+			}
+		}
+
+		base, err := signatureBase(req, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if !strings.Contains(base, "oauth_timestamp%3D"+timestamp) {
+			t.Errorf("%d. oauth_timestamp should be signed\nhave %s", i, base)
+		}
+
+		if len(params) > 1 {
+			t.Errorf("%d. params should not be modified", i)
+		}
+	}
+}
+
+func TestSignSignatureMethod(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tr := *testTransport
+	tr.PrivateKey = key
+
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("HMAC-SHA1 unexpected error %v", err)
+	}
+
+	req, err = http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = tr.Sign(req, url.Values{"oauth_signature_method": {"RSA-SHA1"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = VerifyRSA(req, &key.PublicKey)
+	if err != nil {
+		t.Errorf("RSA-SHA1 unexpected error %v", err)
+	}
+}
+
+func TestSignMissingContentType(t *testing.T) {
+	var tests = []struct {
+		// in
+		requireContentType bool
+		assumeForm         bool
+
+		// out
+		err    error
+		signed bool
+	}{
+		{false, false, nil, false},
+		{true, false, ErrMissingContentType, false},
+		{false, true, nil, true},
+		{true, true, nil, true},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://photos.example.net/photos", strings.NewReader("file=vacation.jpg"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.RequireContentType = tt.requireContentType
+		tr.AssumeForm = tt.assumeForm
+		err = tr.Sign(req, nil)
+		if err != tt.err {
+			t.Errorf("%d. Sign\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		base, err := signatureBase(req, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if signed := strings.Contains(base, "file%3Dvacation.jpg"); signed != tt.signed {
+			t.Errorf("%d. body parameters signed\nhave %v\nwant %v", i, signed, tt.signed)
+		}
+	}
+
+	// A body of unknown length is not read to tell whether it is empty.
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos", unreadBody{t})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tr := *testTransport
+	tr.RequireContentType = true
+	err = tr.Sign(req, nil)
+	if err != ErrMissingContentType {
+		t.Errorf("unknown length\nhave %v\nwant %v", err, ErrMissingContentType)
+	}
+}
+
+func TestSignExtensionParameters(t *testing.T) {
+	tr := *testTransport
+	tr.Token = nil
+
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = tr.Sign(req, url.Values{"xoauth_requestor_id": {"jane@example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	header := req.Header.Get("Authorization")
+	if !strings.Contains(header, `xoauth_requestor_id="jane%40example.com"`) {
+		t.Errorf("xoauth_requestor_id should be in the header\nhave %s", header)
+	}
+
+	base, err := signatureBase(req, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !strings.Contains(base, "xoauth_requestor_id%3Djane%2540example.com") {
+		t.Errorf("xoauth_requestor_id should be signed\nhave %s", base)
+	}
+
+	v := *testVerifier
+	v.AllowTwoLegged = true
+	err = v.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRequestUserAgent(t *testing.T) {
+	var tests = []struct {
+		// in
+		userAgent string
+
+		// out
+		out string
+	}{
+		{"", "oauth1/" + Version + " (+https://github.com/pnelson/oauth1)"},
+		{"photoprinter/2.1", "photoprinter/2.1"},
+	}
+
+	for i, tt := range tests {
+		var userAgent string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.UserAgent()
+			w.Write([]byte("oauth_token=hh5s93j4hdidpola&oauth_token_secret=hdhd0244k9j7ao03"))
+		}))
+
+		tr := &Transport{
+			Key:                     "dpf43f3p2l4k3l03",
+			Secret:                  "kd94hf93k423kf44",
+			TemporaryCredentialsURI: ts.URL,
+			AuthorizationURI:        ts.URL,
+			UserAgent:               tt.userAgent,
+		}
+
+		_, err := tr.RequestTemporaryCredentials()
+		ts.Close()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if userAgent != tt.out {
+			t.Errorf("%d. User-Agent\nhave %s\nwant %s", i, userAgent, tt.out)
+		}
+	}
+}
+
+func TestSignMissingCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tests = []struct {
+		// in
+		method     string
+		secret     string
+		privateKey crypto.Signer
+
+		// out
+		err error
+	}{
+		{"HMAC-SHA1", "kd94hf93k423kf44", nil, nil},
+		{"HMAC-SHA1", "", key, ErrMissingSecret},
+		{"PLAINTEXT", "kd94hf93k423kf44", nil, nil},
+		{"PLAINTEXT", "", key, ErrMissingSecret},
+		{"RSA-SHA1", "", key, nil},
+		{"RSA-SHA1", "kd94hf93k423kf44", nil, ErrMissingRSAKey},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := &Transport{
+			Key:             "dpf43f3p2l4k3l03",
+			Secret:          tt.secret,
+			SignatureMethod: tt.method,
+			PrivateKey:      tt.privateKey,
+		}
+
+		err = tr.Sign(req, nil)
+		if err != tt.err {
+			t.Errorf("%d. Sign %s\nhave %v\nwant %v", i, tt.method, err, tt.err)
+		}
+	}
+}
+
+// externalSigner is a crypto.Signer that hides the type of the key, as a
+// key held by a key management service would.
+type externalSigner struct {
+	crypto.Signer
+}
+
+func TestSignCryptoSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tests = []struct {
+		// in
+		privateKey crypto.Signer
+
+		// out
+		err error
+	}{
+		{externalSigner{key}, nil},
+		{externalSigner{ecKey}, ErrMissingRSAKey},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := &Transport{
+			Key:             "dpf43f3p2l4k3l03",
+			SignatureMethod: "RSA-SHA1",
+			PrivateKey:      tt.privateKey,
+		}
+
+		err = tr.Sign(req, nil)
+		if err != tt.err {
+			t.Errorf("%d. Sign\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if tt.err != nil {
+			continue
+		}
+
+		err = VerifyRSA(req, &key.PublicKey)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignBaseStringHook(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The provider leaves the query out of the base string.
+	tr := *testTransport
+	tr.BaseStringHook = func(base string) string {
+		return strings.Replace(base, "%26size%3Doriginal", "", 1)
+	}
+
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	base, err := signatureBase(req, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected, err := sign(tr.BaseStringHook(base), "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := params.Get("oauth_signature"); v != expected {
+		t.Errorf("oauth_signature\nhave %s\nwant %s", v, expected)
+	}
+}
+
+func TestRoundTripRequestID(t *testing.T) {
+	var sent *http.Request
+	tr := *testTransport
+	tr.RequestID = func() string { return "f058ebd6-02f7-4d3f-942e-904344e8cde5" }
+	tr.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	_, err := tr.Client().Get("http://photos.example.net/photos")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := sent.Header.Get("X-Request-Id"); v != "f058ebd6-02f7-4d3f-942e-904344e8cde5" {
+		t.Errorf("X-Request-Id\nhave %s\nwant %s", v, "f058ebd6-02f7-4d3f-942e-904344e8cde5")
+	}
+
+	base, err := signatureBase(sent, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if strings.Contains(base, "f058ebd6") {
+		t.Errorf("X-Request-Id should not be signed\nhave %s", base)
+	}
+
+	err = testVerifier.Verify(sent)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRoundTripRetries(t *testing.T) {
+	var tests = []struct {
+		// in
+		retries int
+
+		// out
+		status int
+	}{
+		{0, http.StatusUnauthorized},
+		{1, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		nonces := make(map[string]bool)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params, err := parseAuthorizationHeader(r, nil)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+
+			nonce := params.Get("oauth_nonce")
+			if len(nonces) == 0 || nonces[nonce] {
+				nonces[nonce] = true
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("oauth_problem=nonce_used"))
+				return
+			}
+
+			nonces[nonce] = true
+		}))
+
+		tr := *testTransport
+		tr.Retries = tt.retries
+		response, err := tr.Client().Post(ts.URL, "application/x-www-form-urlencoded", strings.NewReader("file=vacation.jpg"))
+		ts.Close()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		response.Body.Close()
+		if response.StatusCode != tt.status {
+			t.Errorf("%d. status\nhave %d\nwant %d", i, response.StatusCode, tt.status)
+		}
+
+		if len(nonces) != tt.retries+1 {
+			t.Errorf("%d. each attempt should use a fresh nonce\nhave %d\nwant %d", i, len(nonces), tt.retries+1)
+		}
+	}
+}
+
+func TestRoundTripRetriesHeaderCache(t *testing.T) {
+	var tests = []struct {
+		// in
+		bodyHash    bool
+		assumeForm  bool
+		contentType string
+	}{
+		{false, false, "application/x-www-form-urlencoded"},
+		{true, false, "application/octet-stream"},
+		{false, true, ""},
+	}
+
+	for i, tt := range tests {
+		var headers []string
+		tr := *testTransport
+		tr.Retries = 1
+		tr.HeaderCache = NewHeaderCache(time.Minute)
+		tr.AssumeForm = tt.assumeForm
+		if tt.bodyHash {
+			tr.BodyHash = sha1.New
+		}
+
+		tr.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			headers = append(headers, req.Header.Get("Authorization"))
+			if len(headers) == 1 {
+				return &http.Response{
+					StatusCode: http.StatusUnauthorized,
+					Header:     http.Header{"Www-Authenticate": {`OAuth oauth_problem="nonce_used"`}},
+					Body:       ioutil.NopCloser(strings.NewReader("oauth_problem=nonce_used")),
+				}, nil
+			}
+
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		})
+
+		req, err := http.NewRequest("POST", "http://photos.example.net/photos", strings.NewReader("file=vacation.jpg"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+
+		_, err = tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if len(headers) != 2 {
+			t.Fatalf("%d. attempts\nhave %d\nwant %d", i, len(headers), 2)
+		}
+
+		if headers[0] == headers[1] {
+			t.Errorf("%d. the retry should not reuse the rejected header\nhave %s", i, headers[1])
+		}
+	}
+}
+
+func TestSignedForm(t *testing.T) {
+	form := url.Values{"file": {"vacation.jpg"}, "title": {"Summer & Sun"}}
+	header, body, err := testTransport.SignedForm("http://photos.example.net/photos", form)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if body != form.Encode() {
+		t.Errorf("body\nhave %s\nwant %s", body, form.Encode())
+	}
+
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", header)
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	req.Body = ioutil.NopCloser(strings.NewReader("file=vacation.jpg"))
+	err = testVerifier.Verify(req)
+	if err != ErrInvalidSignature {
+		t.Errorf("form values should be signed\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestSignMap(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	form := map[string]string{"file": "vacation.jpg", "title": "Summer & Sun"}
+	err = testTransport.SignMap(req, form)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type\nhave %s\nwant %s", ct, "application/x-www-form-urlencoded")
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "file=vacation.jpg&title=Summer+%26+Sun"
+	if string(b) != expected {
+		t.Errorf("body\nhave %s\nwant %s", b, expected)
+	}
+
+	req.Body = ioutil.NopCloser(strings.NewReader("file=vacation.jpg"))
+	err = testVerifier.Verify(req)
+	if err != ErrInvalidSignature {
+		t.Errorf("form values should be signed\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestSignEncodedSecrets(t *testing.T) {
+	tr := &Transport{
+		Key:    "dpf43f3p2l4k3l03",
+		Secret: "kd94&hf93 k423",
+		Token: &Token{
+			Key:    "nnch734d00sl2jdk",
+			Secret: "pf=kk dhi",
+		},
+	}
+
+	expected := "kd94%26hf93%20k423&pf%3Dkk%20dhi"
+	if key := tr.key(); key != expected {
+		t.Errorf("key\nhave %s\nwant %s", key, expected)
+	}
+
+	// The reference signature was computed independently with the key
+	// above.
+	base := "GET&http%3A%2F%2Fphotos.example.net%2Fphotos&size%3Doriginal"
+	signature, err := tr.signature("HMAC-SHA1", base)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if signature != "j4BM0RexIAV/FW7kWMIpVZgckns=" {
+		t.Errorf("signature\nhave %s\nwant %s", signature, "j4BM0RexIAV/FW7kWMIpVZgckns=")
+	}
+
+	for _, method := range []string{"HMAC-SHA1", "PLAINTEXT"} {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr.SignatureMethod = method
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := &Verifier{
+			ConsumerSecret: func(key string) ([]string, error) {
+				return []string{"kd94&hf93 k423"}, nil
+			},
+			TokenSecret: func(token string) ([]string, error) {
+				return []string{"pf=kk dhi"}, nil
+			},
+		}
+
+		err = v.Verify(req)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", method, err)
+		}
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	tr := testTransport.WithToken(&Token{Key: "hh5s93j4hdidpola", Secret: "hdhd0244k9j7ao03"})
+	if tr.Token.Key != "hh5s93j4hdidpola" {
+		t.Errorf("Token.Key\nhave %s\nwant %s", tr.Token.Key, "hh5s93j4hdidpola")
+	}
+
+	if testTransport.Token.Key != "nnch734d00sl2jdk" {
+		t.Errorf("Transport should not be modified\nhave %s\nwant %s", testTransport.Token.Key, "nnch734d00sl2jdk")
+	}
+
+	expected := "kd94hf93k423kf44&hdhd0244k9j7ao03"
+	if key := tr.key(); key != expected {
+		t.Errorf("key\nhave %s\nwant %s", key, expected)
+	}
+
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	v := *testVerifier
+	v.TokenSecret = func(token string) ([]string, error) {
+		if token != "hh5s93j4hdidpola" {
+			return nil, fmt.Errorf("unexpected token %s", token)
+		}
+
+		return []string{"hdhd0244k9j7ao03"}, nil
+	}
+
+	err = v.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSignRealm(t *testing.T) {
+	var tests = []struct {
+		// in
+		encodeRealm bool
+
+		// out
+		prefix string
+	}{
+		{false, `OAuth realm="Photo Prints",`},
+		{true, `OAuth realm="Photo%20Prints",`},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.Realm = "Photo Prints"
+		tr.EncodeRealm = tt.encodeRealm
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, tt.prefix) {
+			t.Errorf("%d. Authorization\nhave %s\nwant prefix %s", i, header, tt.prefix)
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignRealmSigned(t *testing.T) {
+	var tests = []struct {
+		// in
+		signRealm   bool
+		encodeRealm bool
+
+		// out
+		signed bool
+	}{
+		{false, false, false},
+		{true, false, true},
+		{true, true, true},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		base := ""
+		tr := *testTransport
+		tr.Realm = "Photo Prints"
+		tr.EncodeRealm = tt.encodeRealm
+		tr.Normalization.SignRealm = tt.signRealm
+		tr.BaseStringHook = func(s string) string {
+			base = s
+			return s
+		}
+
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		signed := strings.Contains(base, "realm%3DPhoto%2520Prints")
+		if signed != tt.signed {
+			t.Errorf("%d. realm signed %v\nhave %s", i, tt.signed, base)
+		}
+
+		v := *testVerifier
+		v.Normalization.SignRealm = tt.signRealm
+		err = v.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+
+		// The realm must be signed by both or neither.
+		v.Normalization.SignRealm = !tt.signRealm
+		err = v.Verify(req)
+		if err != ErrInvalidSignature {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, ErrInvalidSignature)
+		}
+	}
+}
+
+func TestSignNumericNonce(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tr := *testTransport
+	tr.NumericNonce = true
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	values, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	nonce := values.Get("oauth_nonce")
+	if nonce == "" || strings.Trim(nonce, "0123456789") != "" {
+		t.Errorf("oauth_nonce should be numeric\nhave %s", nonce)
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	var tests = []struct {
+		// in
+		cache *HeaderCache
+		uri   string
+
+		// out
+		hit bool
+	}{
+		{nil, "http://photos.example.net/photos", false},
+		{NewHeaderCache(time.Minute), "http://photos.example.net/photos", true},
+		{NewHeaderCache(time.Minute), "http://photos.example.net/photos?size=original", false},
+		{NewHeaderCache(0), "http://photos.example.net/photos", false},
+	}
+
+	for i, tt := range tests {
+		tr := *testTransport
+		tr.HeaderCache = tt.cache
+
+		first, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		second, err := tr.NewRequest(context.Background(), "GET", tt.uri, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		hit := first.Header.Get("Authorization") == second.Header.Get("Authorization")
+		if hit != tt.hit {
+			t.Errorf("%d. cache hit\nhave %v\nwant %v", i, hit, tt.hit)
+		}
+
+		err = testVerifier.Verify(second)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignConventionalOrder(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tr := *testTransport
+	tr.ConventionalOrder = true
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	header := req.Header.Get("Authorization")
+	last := 0
+	for _, k := range conventionalOrder {
+		i := strings.Index(header, k+"=")
+		if i < last {
+			t.Errorf("%s should follow the previous parameter\nhave %s", k, header)
+		}
+
+		last = i
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// fakeClock is a Clock that returns a fixed time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestSignClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1191242096, 0)}
+	tr := *testTransport
+	tr.Clock = clock
+	tr.HeaderCache = NewHeaderCache(time.Minute)
+
+	var tests = []struct {
+		// in
+		advance time.Duration
+
+		// out
+		timestamp string
+	}{
+		{0, "1191242096"},
+		{59 * time.Second, "1191242096"},
+		{time.Second, "1191242156"},
+	}
+
+	for i, tt := range tests {
+		clock.now = clock.now.Add(tt.advance)
+		req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		timestamp := values.Get("oauth_timestamp")
+		if timestamp != tt.timestamp {
+			t.Errorf("%d. oauth_timestamp\nhave %s\nwant %s", i, timestamp, tt.timestamp)
+		}
+
+		nonce := values.Get("oauth_nonce")
+		if !strings.HasSuffix(nonce, timestamp) {
+			t.Errorf("%d. oauth_nonce should end with the timestamp\nhave %s", i, nonce)
+		}
+	}
+}
+
+func TestSignSigner(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var signed string
+	tr := &Transport{
+		Key:             "dpf43f3p2l4k3l03",
+		SignatureMethod: "RSA-SHA256",
+		Signer: func(base string) (string, error) {
+			signed = base
+			return "c2lnbmF0dXJl", nil
+		},
+	}
+
+	err = tr.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	values, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := values.Get("oauth_signature"); v != "c2lnbmF0dXJl" {
+		t.Errorf("oauth_signature\nhave %s\nwant %s", v, "c2lnbmF0dXJl")
+	}
+
+	if v := values.Get("oauth_signature_method"); v != "RSA-SHA256" {
+		t.Errorf("oauth_signature_method\nhave %s\nwant %s", v, "RSA-SHA256")
+	}
+
+	base, err := SignatureBaseString(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if signed != base {
+		t.Errorf("Signer should receive the base string\nhave %s\nwant %s", signed, base)
+	}
+}
+
+func TestFixedAuthorizationHeader(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// See RFC 5849 Section 1.2.
+	expected := `OAuth oauth_consumer_key="dpf43f3p2l4k3l03",` +
+		`oauth_nonce="kllo9940pd9333jh",` +
+		`oauth_signature="tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D",` +
+		`oauth_signature_method="HMAC-SHA1",` +
+		`oauth_timestamp="1191242096",` +
+		`oauth_token="nnch734d00sl2jdk",` +
+		`oauth_version="1.0"`
+
+	for i := 0; i < 2; i++ {
+		header, err := testTransport.FixedAuthorizationHeader(req, "kllo9940pd9333jh", "1191242096")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if header != expected {
+			t.Errorf("%d. Authorization\nhave %s\nwant %s", i, header, expected)
+		}
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("request should not be modified")
+	}
+}
+
+func TestSignGetBody(t *testing.T) {
+	// A body of unknown type is not replayable by default.
+	body := struct{ io.Reader }{strings.NewReader("title=Sunset&size=original")}
+	req, err := testTransport.NewRequest(context.Background(), "POST", "http://photos.example.net/photos", body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if req.GetBody == nil {
+		t.Fatalf("GetBody should be set")
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := req.GetBody()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if string(b) != "title=Sunset&size=original" {
+			t.Errorf("%d. GetBody\nhave %s\nwant %s", i, b, "title=Sunset&size=original")
+		}
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRoundTripDryRun(t *testing.T) {
+	var signed *http.Request
+	var signedBase string
+	tr := *testTransport
+	tr.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("request should not be sent")
+		return nil, fmt.Errorf("unexpected request")
+	})
+	tr.DryRun = func(req *http.Request, base string) {
+		signed = req
+		signedBase = base
+	}
+
+	response, err := tr.Client().Post("http://photos.example.net/photos", "application/x-www-form-urlencoded", strings.NewReader("title=Sunset"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode\nhave %d\nwant %d", response.StatusCode, http.StatusOK)
+	}
+
+	if signed == nil || signed.Header.Get("Authorization") == "" {
+		t.Fatalf("signed request should be surfaced")
+	}
+
+	base, err := SignatureBaseString(signed)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if signedBase != base {
+		t.Errorf("base string\nhave %s\nwant %s", signedBase, base)
+	}
+
+	err = testVerifier.Verify(signed)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSignBodyHash(t *testing.T) {
+	var tests = []struct {
+		// in
+		hash        func() hash.Hash
+		parameter   string
+		contentType string
+		body        string
+
+		// out
+		name   string
+		digest string
+	}{
+		{nil, "", "application/json", `{"title":"Sunset"}`, "oauth_body_hash", ""},
+		{sha1.New, "", "application/json", `{"title":"Sunset"}`, "oauth_body_hash", "M8e1HEabefjfMm/BM3+Sx5mpVDM="},
+		{sha256.New, "xoauth_body_sha256", "application/json", `{"title":"Sunset"}`, "xoauth_body_sha256", "X93O+tm5NP4NyKqarB17GMG31O+Nd2tRWGZw6QNMehw="},
+		{sha1.New, "", "application/json", "", "oauth_body_hash", "2jmj7l5rSw0yVb/vlWAYkK/YBwk="},
+		{sha1.New, "", "application/x-www-form-urlencoded", "title=Sunset", "oauth_body_hash", ""},
+		{sha1.New, "", "application/x-www-form-urlencoded; charset=utf-8", "title=Sunset", "oauth_body_hash", ""},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://photos.example.net/photos", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", tt.contentType)
+
+		tr := *testTransport
+		tr.BodyHash = tt.hash
+		tr.BodyHashParameter = tt.parameter
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if digest := values.Get(tt.name); digest != tt.digest {
+			t.Errorf("%d. %s\nhave %s\nwant %s", i, tt.name, digest, tt.digest)
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignSetDate(t *testing.T) {
+	var tests = []struct {
+		// in
+		setDate bool
+
+		// out
+		date string
+	}{
+		{false, ""},
+		{true, "Mon, 01 Oct 2007 12:34:56 GMT"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.Clock = &fakeClock{now: time.Date(2007, 10, 1, 12, 34, 56, 0, time.UTC)}
+		tr.SetDate = tt.setDate
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if date := req.Header.Get("Date"); date != tt.date {
+			t.Errorf("%d. Date\nhave %s\nwant %s", i, date, tt.date)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if timestamp := values.Get("oauth_timestamp"); timestamp != "1191242096" {
+			t.Errorf("%d. oauth_timestamp\nhave %s\nwant %s", i, timestamp, "1191242096")
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignSetDateOmittedTimestamp(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tr := *testTransport
+	tr.Clock = &fakeClock{now: time.Date(2007, 10, 1, 12, 34, 56, 0, time.UTC)}
+	tr.SetDate = true
+	err = tr.Sign(req, url.Values{"oauth_timestamp": {""}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if date := req.Header.Get("Date"); date != "" {
+		t.Errorf("Date\nhave %s\nwant %s", date, "")
+	}
+
+	values, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if _, ok := values["oauth_timestamp"]; ok {
+		t.Errorf("unexpected oauth_timestamp %s", values.Get("oauth_timestamp"))
+	}
+}
+
+func TestSignMillisecondTimestamp(t *testing.T) {
+	var tests = []struct {
+		// in
+		millisecond bool
+
+		// out
+		timestamp string
+	}{
+		{false, "1191242096"},
+		{true, "1191242096789"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.Clock = &fakeClock{now: time.Date(2007, 10, 1, 12, 34, 56, 789000000, time.UTC)}
+		tr.MillisecondTimestamp = tt.millisecond
+		tr.SetDate = true
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if timestamp := values.Get("oauth_timestamp"); timestamp != tt.timestamp {
+			t.Errorf("%d. oauth_timestamp\nhave %s\nwant %s", i, timestamp, tt.timestamp)
+		}
+
+		// The Date is the same regardless of the unit of the timestamp.
+		if date := req.Header.Get("Date"); date != "Mon, 01 Oct 2007 12:34:56 GMT" {
+			t.Errorf("%d. Date\nhave %s\nwant %s", i, date, "Mon, 01 Oct 2007 12:34:56 GMT")
+		}
+	}
+}
+
+func TestCurlCommand(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos?size=original", strings.NewReader("title=Rock's+Sunset"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	command, err := testTransport.CurlCommand(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, part := range []string{
+		"curl -X POST -H 'Authorization: OAuth oauth_consumer_key=\"dpf43f3p2l4k3l03\",",
+		"oauth_signature=",
+		" -H 'Content-Type: application/x-www-form-urlencoded' ",
+		` --data-raw 'title=Rock'\''s+Sunset' `,
+		" 'http://photos.example.net/photos?size=original'",
+	} {
+		if !strings.Contains(command, part) {
+			t.Errorf("CurlCommand should contain %s\nhave %s", part, command)
+		}
+	}
+
+	if strings.Contains(command, testTransport.Secret) || strings.Contains(command, testTransport.Token.Secret) {
+		t.Errorf("secrets should not be included\nhave %s", command)
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("request should not be modified")
+	}
+}
+
+func TestSignSignatureEncoding(t *testing.T) {
+	var tests = []struct {
+		// in
+		encoding *base64.Encoding
+
+		// out
+		signature string
+	}{
+		{nil, "tR3+Ty81lMeYAr/Fid0kMTYa/WM="},
+		{base64.StdEncoding, "tR3+Ty81lMeYAr/Fid0kMTYa/WM="},
+		{base64.URLEncoding, "tR3-Ty81lMeYAr_Fid0kMTYa_WM="},
+		{base64.RawURLEncoding, "tR3-Ty81lMeYAr_Fid0kMTYa_WM"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.SignatureEncoding = tt.encoding
+		header, err := tr.FixedAuthorizationHeader(req, "kllo9940pd9333jh", "1191242096")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Authorization", header)
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if signature := values.Get("oauth_signature"); signature != tt.signature {
+			t.Errorf("%d. oauth_signature\nhave %s\nwant %s", i, signature, tt.signature)
+		}
+	}
+}
+
+func TestSignClockSkew(t *testing.T) {
+	var tests = []struct {
+		// in
+		skew time.Duration
+
+		// out
+		timestamp string
+	}{
+		{0, "1191242096"},
+		{90 * time.Second, "1191242186"},
+		{-90 * time.Second, "1191242006"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := *testTransport
+		tr.Clock = &fakeClock{now: time.Unix(1191242096, 0)}
+		tr.ClockSkew = tt.skew
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if timestamp := values.Get("oauth_timestamp"); timestamp != tt.timestamp {
+			t.Errorf("%d. oauth_timestamp\nhave %s\nwant %s", i, timestamp, tt.timestamp)
+		}
+	}
+}
+
+func TestSignOverrides(t *testing.T) {
+	var tests = []struct {
+		// in
+		params url.Values
+
+		// out
+		realm   string
+		version string
+		token   string
+	}{
+		{url.Values{}, "Photos", "1.0", "nnch734d00sl2jdk"},
+		{url.Values{"oauth_version": {""}}, "Photos", "", "nnch734d00sl2jdk"},
+		{url.Values{"realm": {"Prints"}}, "Prints", "1.0", "nnch734d00sl2jdk"},
+		{url.Values{"realm": {""}}, "", "1.0", "nnch734d00sl2jdk"},
+		{url.Values{"oauth_token": {"hh5s93j4hdidpola"}}, "Photos", "1.0", "hh5s93j4hdidpola"},
+	}
+
+	tr := *testTransport
+	tr.Realm = "Photos"
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		err = tr.Sign(req, tt.params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		header := req.Header.Get("Authorization")
+		realm := ""
+		if strings.HasPrefix(header, `OAuth realm="`) {
+			realm = strings.SplitN(header, `"`, 3)[1]
+		}
+
+		if realm != tt.realm {
+			t.Errorf("%d. realm\nhave %s\nwant %s", i, realm, tt.realm)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if _, ok := values["oauth_version"]; ok != (tt.version != "") || values.Get("oauth_version") != tt.version {
+			t.Errorf("%d. oauth_version\nhave %v\nwant %s", i, values["oauth_version"], tt.version)
+		}
+
+		if token := values.Get("oauth_token"); token != tt.token {
+			t.Errorf("%d. oauth_token\nhave %s\nwant %s", i, token, tt.token)
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+
+	if tr.Realm != "Photos" || tr.Token.Key != "nnch734d00sl2jdk" {
+		t.Errorf("Transport should not be modified")
+	}
+}
+
+func TestSignEmptyParameters(t *testing.T) {
+	var tests = []url.Values{
+		{"xoauth_requestor_id": {}},
+		{"xoauth_requestor_id": {""}},
+		{"oauth_verifier": {""}},
+		{"oauth_verifier": {"", ""}},
+	}
+
+	for i, params := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		err = testTransport.Sign(req, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		for k := range params {
+			if _, ok := values[k]; ok {
+				t.Errorf("%d. %s should be omitted\nhave %s", i, k, req.Header.Get("Authorization"))
+			}
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignWithTimeout(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	r, cancel, err := testTransport.SignWithTimeout(req, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	deadline, ok := r.Context().Deadline()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("request should carry the deadline\nhave %v", deadline)
+	}
+
+	if r.Context().Err() != nil {
+		t.Errorf("context should not be canceled before cancel is called")
+	}
+
+	err = testVerifier.Verify(r)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("request should not be modified")
+	}
+
+	cancel()
+	if r.Context().Err() != context.Canceled {
+		t.Errorf("context should be canceled\nhave %v\nwant %v", r.Context().Err(), context.Canceled)
+	}
+}
+
+func TestSignOnNonce(t *testing.T) {
+	type nonce struct {
+		nonce     string
+		timestamp string
+	}
+
+	var observed []nonce
+	tr := *testTransport
+	tr.Clock = &fakeClock{now: time.Unix(1191242096, 0)}
+	tr.OnNonce = func(n, timestamp string) {
+		observed = append(observed, nonce{n, timestamp})
+	}
+
+	var sent []nonce
+	for _, params := range []url.Values{{}, {}, {"oauth_nonce": {"kllo9940pd9333jh"}}} {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		err = tr.Sign(req, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		values, err := parseAuthorizationHeader(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if params.Get("oauth_nonce") == "" {
+			sent = append(sent, nonce{values.Get("oauth_nonce"), values.Get("oauth_timestamp")})
+		}
+	}
+
+	if !reflect.DeepEqual(observed, sent) {
+		t.Errorf("OnNonce should observe each generated nonce\nhave %v\nwant %v", observed, sent)
+	}
+}
@@ -1,104 +1,641 @@
 package oauth1
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"hash"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/idna"
 )
 
 var (
 	errAuthHeaderParam = errors.New("request header Authorization is malformed")
+	errOpaqueURL       = errors.New("request URL is opaque without a path")
+	errFormTooLarge    = errors.New("request body form is too large")
 )
 
+// Normalization configures deviations from RFC 5849 made when constructing
+// the signature base string. The zero value conforms to the specification.
+// The client and server must agree on the Normalization for signatures to
+// match.
+type Normalization struct {
+	// ServerName uses the TLS server name indication of a request received
+	// by a server as the host of the base string URI. The port, if any, is
+	// retained. Requests without a server name are unaffected.
+	ServerName bool
+
+	// TrimTrailingDot removes a single trailing dot from a fully qualified
+	// host such as "example.com." to match providers that normalize it away.
+	// RFC 5849 does not address this and the dot is retained by default.
+	TrimTrailingDot bool
+
+	// PunycodeHost converts an internationalized host such as
+	// "münchen.example" to its ASCII form "xn--mnchen-3ya.example" to match
+	// providers that sign the host as sent in the Host header, since the
+	// net/http package sends the ASCII form. The conversion is the one
+	// net/http performs, so the host is neither mapped nor validated beyond
+	// being encodable. The host is otherwise used as given in the request.
+	// Hosts that are already ASCII are unaffected.
+	//
+	// See RFC 3492.
+	PunycodeHost bool
+
+	// LiteralPlus treats a plus in the query as a literal plus rather than
+	// an encoded space. RFC 5849 Section 3.4.1.3.1 requires the query to be
+	// decoded as application/x-www-form-urlencoded, in which a plus is a
+	// space, but some providers follow RFC 3986 where it has no special
+	// meaning. The plus is always a space in an entity body. A query built
+	// with url.Values.Encode encodes spaces as a plus, so it is signed as
+	// intended only when LiteralPlus is false.
+	LiteralPlus bool
+
+	// SpaceSeparatedHeader accepts Authorization header parameters that are
+	// separated by whitespace rather than commas, as sent by some clients.
+	// RFC 5849 Section 3.5.1 requires commas.
+	SpaceSeparatedHeader bool
+
+	// SemicolonSeparator treats a semicolon in the query as a separator
+	// between parameters, as in some legacy query strings. Otherwise a
+	// semicolon is part of the parameter value, as in the
+	// application/x-www-form-urlencoded format required by RFC 5849
+	// Section 3.4.1.3.1.
+	SemicolonSeparator bool
+
+	// LowercaseHeaderNames lowercases the names of Authorization header
+	// parameters that begin with oauth_ in any case, such as
+	// OAuth_Consumer_Key, as sent by some clients. Parameter names are case
+	// sensitive per RFC 5849 Section 3.4.1.3.2, so these parameters are
+	// otherwise not recognized as protocol parameters.
+	LowercaseHeaderNames bool
+
+	// SignRealm includes the realm of the Authorization header in the
+	// signature base string as some non-conformant providers do. RFC 5849
+	// Section 3.4.1.3.1 excludes it, so it is not signed by default. The
+	// realm is decoded if it is percent-encoded.
+	SignRealm bool
+
+	// Exclude lists the names of request parameters that are left out of
+	// the signature base string, such as a cache-busting query parameter
+	// that is added to the request after it has been signed. The parameters
+	// are still sent with the request.
+	Exclude []string
+}
+
 // authenticate calculates the values of a set of protocol parameters and
 // returns the signed Authorization header
 //
 // See RFC 5849 Section 3.1.
-func authenticate(req *http.Request, params url.Values, key string) (string, error) {
-	base, err := signatureBase(req, params)
+func authenticate(req *http.Request, params url.Values, n *Normalization, conventional bool, signer func(base string) (string, error)) (string, error) {
+	base, err := signatureBase(req, params, n)
 	if err != nil {
 		return "", err
 	}
 
-	signature, err := sign(base, key)
+	signature, err := signer(base)
 	if err != nil {
 		return "", err
 	}
 
 	params.Add("oauth_signature", signature)
 
-	return makeAuthorizationHeader(params), nil
+	return makeAuthorizationHeader(params, conventional), nil
+}
+
+// AuthorizationHeader returns an Authorization header for a set of protocol
+// parameters that have already been signed, such as those parsed from
+// another request. Parameters without the oauth_ or xoauth_ prefix or
+// without a value are omitted.
+// ErrMissingSignature is returned if the oauth_signature is absent.
+//
+// See RFC 5849 Section 3.5.1.
+func AuthorizationHeader(params url.Values) (string, error) {
+	if params.Get("oauth_signature") == "" {
+		return "", ErrMissingSignature
+	}
+
+	return makeAuthorizationHeader(params, false), nil
+}
+
+// AuthorizationHeaderError describes the problems found in an Authorization
+// header by ValidateAuthorizationHeader.
+type AuthorizationHeaderError struct {
+	// Missing lists the required protocol parameters that are absent.
+	Missing []string
+
+	// Malformed lists the parameters that are not quoted, are not percent
+	// encoded as required, are repeated or have an invalid value.
+	Malformed []string
+}
+
+func (e *AuthorizationHeaderError) Error() string {
+	var problems []string
+	if len(e.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(e.Missing, ", "))
+	}
+
+	if len(e.Malformed) > 0 {
+		problems = append(problems, "malformed "+strings.Join(e.Malformed, ", "))
+	}
+
+	return errAuthHeaderParam.Error() + ": " + strings.Join(problems, "; ")
+}
+
+// ValidateAuthorizationHeader returns nil if the Authorization header is a
+// conformant OAuth header containing the protocol parameters required of a
+// signed request. An *AuthorizationHeaderError lists each missing or
+// malformed parameter. The signature is not verified.
+//
+// See RFC 5849 Section 3.5.1.
+func ValidateAuthorizationHeader(header string) error {
+	if len(header) < 6 || !strings.EqualFold(header[:6], "oauth ") {
+		return errAuthHeaderParam
+	}
+
+	e := &AuthorizationHeaderError{}
+	params := url.Values{}
+	for _, part := range splitAuthorizationHeader(header[6:], false) {
+		// An empty part, such as after a trailing comma, is ignored and a
+		// part without a name is listed as it appears.
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		param := strings.SplitN(part, "=", 2)
+		if param[0] == "" {
+			e.Malformed = append(e.Malformed, part)
+			continue
+		}
+
+		if len(param) != 2 || !isQuoted(param[1]) {
+			e.Malformed = append(e.Malformed, param[0])
+			continue
+		}
+
+		// The realm may not be percent-encoded and is not signed.
+		raw := param[1][1 : len(param[1])-1]
+		if param[0] == "realm" {
+			continue
+		}
+
+		value, err := url.PathUnescape(raw)
+		if err != nil || encode(value) != raw {
+			e.Malformed = append(e.Malformed, param[0])
+			continue
+		}
+
+		if _, ok := params[param[0]]; ok {
+			e.Malformed = append(e.Malformed, param[0])
+			continue
+		}
+
+		params.Set(param[0], value)
+	}
+
+	required := []string{"oauth_consumer_key", "oauth_signature_method", "oauth_signature"}
+	if params.Get("oauth_signature_method") != "PLAINTEXT" {
+		required = append(required, "oauth_timestamp", "oauth_nonce")
+	}
+
+	// Parameters that are present but malformed are not also missing.
+	for _, k := range required {
+		if params.Get(k) == "" && !contains(e.Malformed, k) {
+			e.Missing = append(e.Missing, k)
+		}
+	}
+
+	if timestamp := params.Get("oauth_timestamp"); timestamp != "" {
+		n, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || n <= 0 {
+			e.Malformed = append(e.Malformed, "oauth_timestamp")
+		}
+	}
+
+	if _, ok := params["oauth_version"]; ok && params.Get("oauth_version") != "1.0" {
+		e.Malformed = append(e.Malformed, "oauth_version")
+	}
+
+	if len(e.Missing) > 0 || len(e.Malformed) > 0 {
+		return e
+	}
+
+	return nil
+}
+
+// contains returns true if s is in values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
 }
 
 // makeAuthorizationHeader returns the value for the Authorize header.
+// Extension parameters with the xoauth_ prefix are included alongside the
+// protocol parameters. Parameters without a value are omitted. The
+// parameters are sorted by name, or listed in the conventionalOrder if
+// conventional is true, so that the header is the same for the same
+// parameters.
 //
 // See RFC 5849 Section 3.1.
-func makeAuthorizationHeader(params url.Values) string {
-	rv := "OAuth "
-	for k, v := range params {
-		if strings.HasPrefix(k, "oauth_") {
-			rv += k + `="` + encode(v[0]) + `",`
+func makeAuthorizationHeader(params url.Values, conventional bool) string {
+	keys := make([]string, 0, len(params))
+	for k, vs := range params {
+		if len(vs) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(k, "oauth_") || strings.HasPrefix(k, "xoauth_") {
+			keys = append(keys, k)
 		}
 	}
 
+	sort.Strings(keys)
+	if conventional {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return conventionalRank(keys[i]) < conventionalRank(keys[j])
+		})
+	}
+
+	rv := "OAuth "
+	for _, k := range keys {
+		rv += k + `="` + encode(params[k][0]) + `",`
+	}
+
 	return rv[:len(rv)-1]
 }
 
+// conventionalOrder is the order in which the protocol parameters are
+// commonly listed in the Authorization header, as in the examples of
+// RFC 5849. The order has no effect on the signature.
+var conventionalOrder = []string{
+	"oauth_consumer_key",
+	"oauth_token",
+	"oauth_signature_method",
+	"oauth_timestamp",
+	"oauth_nonce",
+	"oauth_version",
+	"oauth_signature",
+}
+
+// conventionalRank returns the position of the parameter in the
+// conventionalOrder. Other parameters are placed before the signature.
+func conventionalRank(k string) int {
+	for i, v := range conventionalOrder {
+		if v == k {
+			return i * 2
+		}
+	}
+
+	return (len(conventionalOrder)-1)*2 - 1
+}
+
+// addRealm returns the Authorization header with the realm parameter added
+// as the first parameter. The realm is percent-encoded if encoded is true.
+//
+// See RFC 5849 Section 3.5.1.
+func addRealm(header, realm string, encoded bool) string {
+	if encoded {
+		realm = encode(realm)
+	}
+
+	return `OAuth realm="` + realm + `",` + header[len("OAuth "):]
+}
+
 // generateTimestamp returns the seconds since epoch in UTC as a string.
 //
 // See RFC 5849 Section 3.3.
-func generateTimestamp() string {
-	return strconv.FormatInt(time.Now().Unix(), 10)
+func generateTimestamp(now time.Time) string {
+	return strconv.FormatInt(now.Unix(), 10)
+}
+
+// generateMillisecondTimestamp is like generateTimestamp but returns the
+// number of milliseconds rather than seconds.
+func generateMillisecondTimestamp(now time.Time) string {
+	return strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
 }
 
 // generateNonce returns a random string to prevent replay attacks.
 // The current unix timestamp is appended to random data.
 //
 // See RFC 5849 Section 3.3.
-func generateNonce() (string, error) {
+func generateNonce(now time.Time) (string, error) {
 	b := make([]byte, 24)
 	_, err := rand.Read(b)
 	if err != nil {
 		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(b) + generateTimestamp(), nil
+	return base64.StdEncoding.EncodeToString(b) + generateTimestamp(now), nil
+}
+
+// generateNumericNonce returns a nonce of decimal digits for servers that
+// only accept numeric nonces. The current unix timestamp is appended to a
+// random 64-bit integer.
+//
+// See RFC 5849 Section 3.3.
+func generateNumericNonce(now time.Time) (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 10) + generateTimestamp(now), nil
+}
+
+// SignatureBaseString returns the signature base string for the request,
+// collecting parameters from the query, entity body and Authorization header.
+// A form body is buffered and restored. Other bodies are not read since
+// they are not signed.
+//
+// See RFC 5849 Section 3.4.1.
+func SignatureBaseString(req *http.Request) (string, error) {
+	return signatureBase(req, nil, nil)
+}
+
+// Parameter is a single request parameter.
+type Parameter struct {
+	Key   string
+	Value string
+}
+
+// Parameters returns the parameters of the request that are included in the
+// signature, in the order in which they appear in the signature base string.
+// Unlike a url.Values, the order is stable, which is useful for logging. A
+// form body is buffered and restored.
+//
+// See RFC 5849 Section 3.4.1.3.
+func Parameters(req *http.Request) ([]Parameter, error) {
+	values, err := collectParameters(req, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortParameters(values), nil
+}
+
+// BaseString returns the signature base string for a request with the
+// method and URL carrying params in addition to any parameters in the query.
+// It is equivalent to SignatureBaseString for the same request.
+//
+// See RFC 5849 Section 3.4.1.
+func BaseString(method, rawurl string, params url.Values) (string, error) {
+	req, err := http.NewRequest(method, rawurl, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+
+	return signatureBase(req, params, nil)
+}
+
+// DisplayOptions configures how DisplayBaseString formats a signature base
+// string. The options only affect the displayed string and never the base
+// string that is signed.
+type DisplayOptions struct {
+	// LowercaseMethod lowercases the HTTP method. The debug tools of some
+	// providers display the base string this way, though the method is
+	// always signed in uppercase.
+	LowercaseMethod bool
+}
+
+// DisplayBaseString returns the signature base string formatted for display
+// so that it may be compared with the output of a provider's debug tools.
+// It must not be used to compute a signature.
+//
+// See RFC 5849 Section 3.4.1.1.
+func DisplayBaseString(base string, opts DisplayOptions) string {
+	if !opts.LowercaseMethod {
+		return base
+	}
+
+	i := strings.Index(base, "&")
+	if i < 0 {
+		return strings.ToLower(base)
+	}
+
+	return strings.ToLower(base[:i]) + base[i:]
+}
+
+// DiffBaseStrings compares two signature base strings and describes the
+// first difference between them, such as a parameter that differs in value
+// or is only present in one of them. An empty string is returned if the base
+// strings are equal. This is intended for debugging a signature mismatch by
+// comparing the base string of a request with one reported by a provider.
+func DiffBaseStrings(a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	pa, ok := splitBaseString(a)
+	if !ok {
+		return "first base string is malformed"
+	}
+
+	pb, ok := splitBaseString(b)
+	if !ok {
+		return "second base string is malformed"
+	}
+
+	if pa[0] != pb[0] {
+		return "method differs: " + pa[0] + " vs " + pb[0]
+	}
+
+	if pa[1] != pb[1] {
+		return "base string URI differs: " + pa[1] + " vs " + pb[1]
+	}
+
+	params := [2][]string{splitParameters(pa[2]), splitParameters(pb[2])}
+	for i := 0; i < len(params[0]) || i < len(params[1]); i++ {
+		if i == len(params[0]) {
+			return "parameter " + parameterName(params[1][i]) + " is only in the second base string"
+		}
+
+		if i == len(params[1]) {
+			return "parameter " + parameterName(params[0][i]) + " is only in the first base string"
+		}
+
+		ka, va := splitParameter(params[0][i])
+		kb, vb := splitParameter(params[1][i])
+		switch {
+		case ka < kb:
+			return "parameter " + ka + " is only in the first base string"
+		case ka > kb:
+			return "parameter " + kb + " is only in the second base string"
+		case va != vb:
+			return "parameter " + ka + " differs: " + va + " vs " + vb
+		}
+	}
+
+	return "base strings differ in encoding"
+}
+
+// splitBaseString returns the method, base string URI and normalized
+// parameters of the signature base string with the encoding of the URI and
+// parameters removed.
+func splitBaseString(base string) ([]string, bool) {
+	parts := strings.Split(base, "&")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	for i := 1; i < len(parts); i++ {
+		s, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+
+		parts[i] = s
+	}
+
+	return parts, true
+}
+
+// splitParameters returns the normalized parameters of a signature base
+// string. There are none if the normalized parameters are empty.
+func splitParameters(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, "&")
+}
+
+// splitParameter returns the name and value of a normalized parameter.
+func splitParameter(s string) (string, string) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], s[i+1:]
+}
+
+// parameterName returns the name of a normalized parameter.
+func parameterName(s string) string {
+	k, _ := splitParameter(s)
+	return k
 }
 
 // signatureBase constructs the signature base string for signing purposes.
 //
 // See RFC 5849 Section 3.4.1.1.
-func signatureBase(req *http.Request, extra url.Values) (string, error) {
-	base, err := baseStringURI(req)
+func signatureBase(req *http.Request, extra url.Values, n *Normalization) (string, error) {
+	base, err := baseStringURI(req, n)
 	if err != nil {
 		return "", err
 	}
 
-	values, err := collectParameters(req, extra)
+	values, err := collectParameters(req, extra, n)
 	if err != nil {
 		return "", err
 	}
 
-	params := normalizeParameters(values)
+	return joinBase(req.Method, base, values), nil
+}
+
+// joinBase concatenates the request method, base string URI and normalized
+// request parameters into the signature base string.
+//
+// See RFC 5849 Section 3.4.1.1.
+func joinBase(method, uri string, params url.Values) string {
+	return joinNormalizedBase(method, uri, normalizeParameters(params))
+}
 
-	return req.Method + "&" + encode(base) + "&" + encode(params), nil
+// joinNormalizedBase is like joinBase for parameters that have already been
+// normalized. The method is uppercased since some frameworks provide it in
+// lowercase.
+//
+// See RFC 5849 Section 3.4.1.1.
+func joinNormalizedBase(method, uri, normalized string) string {
+	return strings.ToUpper(method) + "&" + encode(uri) + "&" + encode(normalized)
 }
 
 // baseStringURI parses a http.Request into a base string URI.
 //
 // See RFC 5849 Section 3.4.1.2.
-func baseStringURI(req *http.Request) (string, error) {
-	// Include the port only if it is the default port for the scheme.
+func baseStringURI(req *http.Request, n *Normalization) (string, error) {
+	// Requests received by a server do not carry the scheme in the URL.
 	scheme := strings.ToLower(req.URL.Scheme)
-	hostname := strings.ToLower(req.Host)
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+
+	path, authority, err := requestPath(req.URL)
+	if err != nil {
+		return "", err
+	}
+
+	host := req.Host
+	if host == "" {
+		host = authority
+	}
+
+	if n != nil && n.ServerName && req.TLS != nil && req.TLS.ServerName != "" {
+		host = req.TLS.ServerName
+		if _, port, err := net.SplitHostPort(req.Host); err == nil {
+			host = net.JoinHostPort(host, port)
+		}
+	}
+
+	if n != nil && n.TrimTrailingDot {
+		host = trimTrailingDot(host)
+	}
+
+	if n != nil && n.PunycodeHost {
+		host, err = punycodeHost(host)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return joinBaseStringURI(scheme, host, path), nil
+}
+
+// BaseStringURI returns the base string URI for a request with the scheme,
+// host and escaped path, normalized as for a request by lowercasing the
+// scheme and host and removing the default port. An empty path is "/". It
+// is useful when the components of the request are known separately
+// rather than as an *http.Request.
+//
+// See RFC 5849 Section 3.4.1.2.
+func BaseStringURI(scheme, host, path string) string {
+	if path == "" {
+		path = "/"
+	}
+
+	return joinBaseStringURI(strings.ToLower(scheme), host, path)
+}
+
+// joinBaseStringURI concatenates the lowercase scheme, host and path into
+// the base string URI. The host is lowercased and the port is included only
+// if it is not the default port for the scheme.
+//
+// See RFC 5849 Section 3.4.1.2.
+func joinBaseStringURI(scheme, host, path string) string {
+	hostname := strings.ToLower(host)
 	switch {
 	case scheme == "http" && strings.HasSuffix(hostname, ":80"):
 		hostname = hostname[:len(hostname)-len(":80")]
@@ -106,107 +643,476 @@ func baseStringURI(req *http.Request) (string, error) {
 		hostname = hostname[:len(hostname)-len(":443")]
 	}
 
-	// Remove the query portion from the encoded request URI.
-	u := *req.URL
-	u.RawQuery = ""
-	path := u.RequestURI()
+	return scheme + "://" + hostname + path
+}
 
-	return scheme + "://" + hostname + path, nil
+// requestPath returns the encoded path of the URL without the query, along
+// with the authority if present. An opaque URL must be of the form
+// //host/path or /path, otherwise errOpaqueURL is returned.
+func requestPath(u *url.URL) (path, authority string, err error) {
+	switch {
+	case u.Opaque == "":
+		path = u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+
+		return path, u.Host, nil
+	case strings.HasPrefix(u.Opaque, "//"):
+		authority = u.Opaque[2:]
+		path = "/"
+		if i := strings.Index(authority, "/"); i >= 0 {
+			path = authority[i:]
+			authority = authority[:i]
+		}
+
+		return path, authority, nil
+	case strings.HasPrefix(u.Opaque, "/"):
+		return u.Opaque, u.Host, nil
+	}
+
+	return "", "", errOpaqueURL
+}
+
+// trimTrailingDot removes a single trailing dot from the host, which may
+// include a port.
+func trimTrailingDot(host string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+
+	return net.JoinHostPort(strings.TrimSuffix(hostname, "."), port)
+}
+
+// punycodeHost returns the host, which may include a port, in the ASCII
+// form sent in the Host header by the net/http package. Hosts that are
+// already ASCII are returned unchanged, otherwise the host is converted with
+// the Punycode profile of the idna package as net/http does, which neither
+// maps nor validates the labels.
+func punycodeHost(host string) (string, error) {
+	if isASCII(host) {
+		return host, nil
+	}
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+
+	hostname, err = idna.ToASCII(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	if port != "" {
+		return net.JoinHostPort(hostname, port), nil
+	}
+
+	return hostname, nil
+}
+
+// isASCII returns true if s contains only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
 }
 
 // collectParameters collects parameters from the request.
 //
 // See RFC 5849 Section 3.4.1.3.1.
-func collectParameters(req *http.Request, extra url.Values) (url.Values, error) {
-	params, err := parseAuthorizationHeader(req)
+func collectParameters(req *http.Request, extra url.Values, n *Normalization) (url.Values, error) {
+	rv, err := requestParameters(req, n)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range extra {
+		for _, v := range extra[k] {
+			rv.Add(k, v)
+		}
+	}
+
+	rv.Del("oauth_signature")
+
+	return rv, nil
+}
+
+// requestParameters returns the parameters from the query, entity body and
+// Authorization header of the request, including the oauth_signature. A
+// form body is buffered and restored so that it may be read again.
+//
+// See RFC 5849 Section 3.4.1.3.1.
+func requestParameters(req *http.Request, n *Normalization) (url.Values, error) {
+	body, err := readForm(req)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := parseRequest(req, bytes.NewReader(body), n)
 	if err != nil {
 		return nil, err
 	}
 
+	return values.all(n), nil
+}
+
+// maxFormSize is the largest form body from which parameters are collected.
+const maxFormSize = 10 << 20
+
+// requestValues holds the parameters of a request by their location.
+type requestValues struct {
+	header url.Values
+	query  url.Values
+	form   url.Values
+}
+
+// parseRequest parses the parameters of the Authorization header, query and
+// entity body of the request. The entity body is read from body, which may
+// be nil, only if it is a form sent with a method that permits one. The
+// request is not modified so that it may be shared, unlike with
+// http.Request.ParseForm.
+//
+// See RFC 5849 Section 3.4.1.3.1.
+func parseRequest(req *http.Request, body io.Reader, n *Normalization) (requestValues, error) {
+	header, err := parseAuthorizationHeader(req, n)
+	if err != nil {
+		return requestValues{}, err
+	}
+
+	rv := requestValues{
+		header: header,
+		query:  parseQuery(req.URL.RawQuery, n),
+		form:   url.Values{},
+	}
+
+	// Some frameworks provide the method in lowercase.
+	if body != nil && hasBody(strings.ToUpper(req.Method)) && isForm(req.Header) {
+		rv.form, err = parseForm(body)
+		if err != nil {
+			return requestValues{}, err
+		}
+	}
+
+	return rv, nil
+}
+
+// parseForm decodes the application/x-www-form-urlencoded data read from r
+// one pair at a time, so that the body is not copied in full. Pairs that are
+// not correctly encoded are skipped as by url.ParseQuery. The size of the
+// form is limited as by http.Request.ParseForm.
+func parseForm(r io.Reader) (url.Values, error) {
+	values := url.Values{}
+	br := bufio.NewReader(io.LimitReader(r, maxFormSize+1))
+	n := 0
+	for {
+		pair, err := br.ReadString('&')
+		n += len(pair)
+		if n > maxFormSize {
+			return nil, errFormTooLarge
+		}
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		addFormPair(values, strings.TrimSuffix(pair, "&"))
+		if err == io.EOF {
+			return values, nil
+		}
+	}
+}
+
+// addFormPair decodes the key and value of the pair and adds them to values.
+func addFormPair(values url.Values, pair string) {
+	if pair == "" || strings.Contains(pair, ";") {
+		return
+	}
+
+	k, v := pair, ""
+	if i := strings.Index(pair, "="); i >= 0 {
+		k, v = pair[:i], pair[i+1:]
+	}
+
+	k, err := url.QueryUnescape(k)
+	if err != nil {
+		return
+	}
+
+	v, err = url.QueryUnescape(v)
+	if err != nil {
+		return
+	}
+
+	values[k] = append(values[k], v)
+}
+
+// all returns the parameters from every location. Parameters named in the
+// Exclude list of the Normalization are removed.
+func (v requestValues) all(n *Normalization) url.Values {
 	rv := url.Values{}
-	err = req.ParseForm()
-	if err == nil {
-		for k := range req.Form {
-			for _, v := range req.Form[k] {
+	for _, values := range []url.Values{v.query, v.form, v.header} {
+		for k, vs := range values {
+			for _, v := range vs {
 				rv.Add(k, v)
 			}
 		}
 	}
 
-	for k := range params {
-		for _, v := range params[k] {
-			rv.Add(k, v)
+	if n != nil {
+		for _, k := range n.Exclude {
+			rv.Del(k)
 		}
 	}
 
-	for k := range extra {
-		for _, v := range extra[k] {
-			rv.Add(k, v)
-		}
+	return rv
+}
+
+// parseQuery decodes the query as application/x-www-form-urlencoded data.
+// Pairs that are not correctly encoded are skipped.
+func parseQuery(rawQuery string, n *Normalization) url.Values {
+	// A semicolon is not a separator in application/x-www-form-urlencoded
+	// data, though the net/url package rejects a query containing one.
+	sep := "%3B"
+	if n != nil && n.SemicolonSeparator {
+		sep = "&"
 	}
 
-	rv.Del("oauth_signature")
+	rawQuery = strings.Replace(rawQuery, ";", sep, -1)
 
-	return rv, nil
+	// A plus is a space unless the Normalization treats it as a literal
+	// plus.
+	if n != nil && n.LiteralPlus {
+		rawQuery = strings.Replace(rawQuery, "+", "%2B", -1)
+	}
+
+	values, _ := url.ParseQuery(rawQuery)
+
+	return values
+}
+
+// readForm buffers and restores the request body if it is a form sent with
+// a method that permits one, since no other body contributes parameters.
+// Other bodies are not read.
+func readForm(req *http.Request) ([]byte, error) {
+	if !hasBody(strings.ToUpper(req.Method)) || !isForm(req.Header) {
+		return nil, nil
+	}
+
+	return readBody(req)
 }
 
-// normalizeParameters sorts and encodes url.Values.
+// isForm returns true if the Content-Type of the header is
+// application/x-www-form-urlencoded, with any parameters such as the
+// charset.
+func isForm(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// normalizeParameters sorts and encodes url.Values. Each key and value is
+// encoded once and the result is built in a single buffer since this is on
+// the path of every signature.
 //
 // See RFC 5849 Section 3.4.1.3.2.
 func normalizeParameters(in url.Values) string {
-	rv := ""
-	if in == nil {
+	type pair struct {
+		k, v string
+	}
+
+	n := 0
+	for _, vs := range in {
+		n += len(vs)
+	}
+
+	if n == 0 {
 		return ""
 	}
 
-	params := make(url.Values, len(in))
+	size := 0
+	pairs := make([]pair, 0, n)
 	for k, vs := range in {
-		params[encode(k)] = vs
+		k = encode(k)
+		for _, v := range vs {
+			v = encode(v)
+			pairs = append(pairs, pair{k, v})
+			size += len(k) + len(v) + 2
+		}
 	}
 
-	keys := make([]string, 0, len(params))
-	for k := range params {
-		keys = append(keys, k)
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+
+		return pairs[i].v < pairs[j].v
+	})
+
+	var b strings.Builder
+	b.Grow(size)
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+
+		b.WriteString(p.k)
+		b.WriteByte('=')
+		b.WriteString(p.v)
 	}
 
-	sort.Strings(keys)
-	for _, k := range keys {
-		vs := params[k]
-		values := make([]string, 0, len(vs))
+	return b.String()
+}
+
+// sortParameters returns the parameters sorted by their encoded keys and
+// values.
+//
+// See RFC 5849 Section 3.4.1.3.2.
+func sortParameters(values url.Values) []Parameter {
+	rv := make([]Parameter, 0, len(values))
+	for k, vs := range values {
 		for _, v := range vs {
-			values = append(values, encode(v))
+			rv = append(rv, Parameter{Key: k, Value: v})
 		}
+	}
 
-		sort.Strings(values)
-		for _, v := range values {
-			if len(rv) > 0 {
-				rv += "&"
-			}
-			rv += k + "=" + v
+	sort.Slice(rv, func(i, j int) bool {
+		a, b := encode(rv[i].Key), encode(rv[j].Key)
+		if a != b {
+			return a < b
 		}
-	}
+
+		return encode(rv[i].Value) < encode(rv[j].Value)
+	})
 
 	return rv
 }
 
+// normalizeRawQuery is like normalizeParameters but the query parameters are
+// taken exactly as they appear in rawQuery rather than being decoded and
+// re-encoded. This matches clients that erroneously sign the raw query. The
+// params must contain the decoded query parameters, which are replaced.
+func normalizeRawQuery(params url.Values, rawQuery string) string {
+	type pair struct {
+		k, v string
+	}
+
+	rest := make(url.Values, len(params))
+	for k, vs := range params {
+		rest[k] = append([]string(nil), vs...)
+	}
+
+	query, _ := url.ParseQuery(rawQuery)
+	removeValues(rest, query)
+
+	var pairs []pair
+	for k, vs := range rest {
+		for _, v := range vs {
+			pairs = append(pairs, pair{encode(k), encode(v)})
+		}
+	}
+
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+
+		pairs = append(pairs, pair{kv[0], kv[1]})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+
+		return pairs[i].v < pairs[j].v
+	})
+
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.k + "=" + p.v
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// removeValues removes one occurrence of each value in remove from params.
+func removeValues(params, remove url.Values) {
+	for k, vs := range remove {
+		for _, v := range vs {
+			for i, w := range params[k] {
+				if w == v {
+					params[k] = append(params[k][:i], params[k][i+1:]...)
+					break
+				}
+			}
+
+			if len(params[k]) == 0 {
+				delete(params, k)
+			}
+		}
+	}
+}
+
 // sign returns the HMAC-SHA1 signature from base and key.
 //
 // See RFC 5849 Section 3.4.2.
 func sign(base string, key string) (string, error) {
-	h := hmac.New(sha1.New, []byte(key))
+	return signHMAC(sha1.New, base, key)
+}
+
+// signHMAC returns the HMAC signature from base and key using the hash.
+func signHMAC(newHash func() hash.Hash, base string, key string) (string, error) {
+	b, err := sumHMAC(newHash, base, key)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// sumHMAC returns the HMAC of base and key using the hash before it is
+// base64 encoded.
+func sumHMAC(newHash func() hash.Hash, base string, key string) ([]byte, error) {
+	h := hmac.New(newHash, []byte(key))
 	_, err := h.Write([]byte(base))
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// signRSA returns the RSA-SHA1 signature of base using the private key. The
+// key may be held externally, such as by a key management service, as long
+// as it produces PKCS #1 v1.5 signatures.
+//
+// See RFC 5849 Section 3.4.3.
+func signRSA(base string, key crypto.Signer) (string, error) {
+	h := sha1.Sum([]byte(base))
+	b, err := key.Sign(rand.Reader, h[:], crypto.SHA1)
 	if err != nil {
 		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
 // parseAuthorizationHeader parses the HTTP Authorization header if present.
 // The realm parameter is removed if present.
 //
 // See RFC 5849 Section 3.5.1.
-func parseAuthorizationHeader(req *http.Request) (url.Values, error) {
+func parseAuthorizationHeader(req *http.Request, n *Normalization) (url.Values, error) {
 	header := req.Header.Get("Authorization")
 	if len(header) < 6 {
 		return nil, nil
@@ -217,24 +1123,84 @@ func parseAuthorizationHeader(req *http.Request) (url.Values, error) {
 		return nil, nil
 	}
 
-	parts := strings.Split(header[6:], ",")
+	spaces := n != nil && n.SpaceSeparatedHeader
+	parts := splitAuthorizationHeader(header[6:], spaces)
 	rv := make(url.Values)
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
-		param := strings.Split(part, "=")
-		if len(param) != 2 || param[1] == "" {
+		if part == "" && spaces {
+			continue
+		}
+
+		param := strings.SplitN(part, "=", 2)
+		if len(param) != 2 || !isQuoted(param[1]) {
 			return nil, errAuthHeaderParam
 		}
 
+		// The realm may not be percent-encoded and is not signed.
+		if param[0] == "realm" {
+			if n != nil && n.SignRealm {
+				realm := param[1][1 : len(param[1])-1]
+				if value, err := url.PathUnescape(realm); err == nil {
+					realm = value
+				}
+
+				rv.Add("realm", realm)
+			}
+
+			continue
+		}
+
 		// Add key/value pair without surrounding value quotes.
-		rv.Add(param[0], param[1][1:len(param[1])-1])
-	}
+		value, err := url.PathUnescape(param[1][1 : len(param[1])-1])
+		if err != nil {
+			return nil, errAuthHeaderParam
+		}
 
-	rv.Del("realm")
+		key := param[0]
+		if n != nil && n.LowercaseHeaderNames && strings.HasPrefix(strings.ToLower(key), "oauth_") {
+			key = strings.ToLower(key)
+		}
+
+		rv.Add(key, value)
+	}
 
 	return rv, nil
 }
 
+// splitAuthorizationHeader splits the Authorization header parameters on
+// each comma that is not part of a quoted value. Whitespace is also treated
+// as a separator if spaces is true.
+func splitAuthorizationHeader(s string, spaces bool) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ' ', '\t', '\r', '\n':
+			if !quoted && spaces {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// isQuoted returns true if s is a single value enclosed in double quotes.
+func isQuoted(s string) bool {
+	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' &&
+		!strings.Contains(s[1:len(s)-1], `"`)
+}
+
 // encode performs percent encoding on strings.
 //
 // See RFC 5849 Section 3.6.
@@ -1,9 +1,16 @@
 package oauth1
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -33,7 +40,7 @@ func TestSignatureBase(t *testing.T) {
 		"ethod%3DHMAC-SHA1%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk" +
 		"9d7dh3k39sjv7"
 
-	out, err := signatureBase(req, nil)
+	out, err := signatureBase(req, nil, nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -43,6 +50,156 @@ func TestSignatureBase(t *testing.T) {
 	}
 }
 
+func TestBaseString(t *testing.T) {
+	url := "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b"
+	body := strings.NewReader("c2&a3=2+q")
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", authorizationHeader)
+
+	expected, err := SignatureBaseString(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	params.Add("c2", "")
+	params.Add("a3", "2 q")
+
+	out, err := BaseString("POST", url, params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if out != expected {
+		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
+	}
+}
+
+func TestSignatureBaseLowercaseMethod(t *testing.T) {
+	req, err := http.NewRequest("post", "http://example.com/request?a=1", strings.NewReader("b=2"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	out, err := signatureBase(req, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "POST&http%3A%2F%2Fexample.com%2Frequest&a%3D1%26b%3D2"
+	if out != expected {
+		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
+	}
+}
+
+func TestSignatureBaseConcurrent(t *testing.T) {
+	req, err := http.NewRequest("get", "http://example.com/request?a=1;b=2", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The request is not modified, so it may be shared. Run with the race
+	// detector to confirm.
+	n := &Normalization{SemicolonSeparator: true}
+	expected := "GET&http%3A%2F%2Fexample.com%2Frequest&a%3D1%26b%3D2"
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := signatureBase(req, nil, n)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+
+			if out != expected {
+				t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
+			}
+		}()
+	}
+
+	if req.Method != "get" || req.URL.RawQuery != "a=1;b=2" {
+		t.Errorf("request should not be modified\nhave %s %s", req.Method, req.URL.RawQuery)
+	}
+
+	wg.Wait()
+}
+
+func TestDisplayBaseString(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	base, err := SignatureBaseString(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tests = []struct {
+		// in
+		lowercaseMethod bool
+
+		// out
+		out string
+	}{
+		{false, "GET&http%3A%2F%2Fphotos.example.net%2Fphotos&size%3Doriginal"},
+		{true, "get&http%3A%2F%2Fphotos.example.net%2Fphotos&size%3Doriginal"},
+	}
+
+	for i, tt := range tests {
+		out := DisplayBaseString(base, DisplayOptions{LowercaseMethod: tt.lowercaseMethod})
+		if out != tt.out {
+			t.Errorf("%d. DisplayBaseString\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+
+	if !strings.HasPrefix(base, "GET&") {
+		t.Errorf("method should be signed in uppercase\nhave %s", base)
+	}
+}
+
+func TestDiffBaseStrings(t *testing.T) {
+	const base = "GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dkllo9940pd9333jh%26size%3Doriginal"
+
+	var tests = []struct {
+		// in
+		other string
+
+		// out
+		out string
+	}{
+		{base, ""},
+		{"POST&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dkllo9940pd9333jh%26size%3Doriginal", "method differs: GET vs POST"},
+		{"GET&https%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dkllo9940pd9333jh%26size%3Doriginal", "base string URI differs: http://photos.example.net/photos vs https://photos.example.net/photos"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dchapoh%26size%3Doriginal", "parameter oauth_nonce differs: kllo9940pd9333jh vs chapoh"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26size%3Doriginal", "parameter oauth_nonce is only in the first base string"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dkllo9940pd9333jh%26oauth_version%3D1.0%26size%3Doriginal", "parameter oauth_version is only in the second base string"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_nonce%3Dkllo9940pd9333jh%26size%3Doriginal%26z%3D1", "parameter z is only in the second base string"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&", "parameter file is only in the first base string"},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos", "second base string is malformed"},
+	}
+
+	for i, tt := range tests {
+		out := DiffBaseStrings(base, tt.other)
+		if out != tt.out {
+			t.Errorf("%d. DiffBaseStrings\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
 func TestBaseStringURI(t *testing.T) {
 	var tests = []struct {
 		// in
@@ -64,7 +221,7 @@ func TestBaseStringURI(t *testing.T) {
 			t.Fatalf("unexpected error %v", err)
 		}
 
-		out, err := baseStringURI(req)
+		out, err := baseStringURI(req, nil)
 		if err != nil {
 			t.Fatalf("unexpected error %v", err)
 		}
@@ -75,6 +232,210 @@ func TestBaseStringURI(t *testing.T) {
 	}
 }
 
+func TestBaseStringURIComponents(t *testing.T) {
+	var tests = []struct {
+		// in
+		scheme string
+		host   string
+		path   string
+	}{
+		{"http", "EXAMPLE.COM:80", "/r%20v/X"},
+		{"HTTPS", "www.example.net:8080", "/"},
+		{"https", "Photos.Example.net:443", "/photos"},
+		{"http", "example.com:443", ""},
+	}
+
+	for i, tt := range tests {
+		out := BaseStringURI(tt.scheme, tt.host, tt.path)
+
+		req, err := http.NewRequest("GET", tt.scheme+"://"+tt.host+tt.path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		expected, err := baseStringURI(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != expected {
+			t.Errorf("%d. BaseStringURI\nhave %s\nwant %s", i, out, expected)
+		}
+	}
+}
+
+func TestBaseStringURIPunycode(t *testing.T) {
+	var tests = []struct {
+		// in
+		host     string
+		punycode bool
+
+		// out
+		out string
+	}{
+		{"münchen.example", false, "http://münchen.example/"},
+		{"münchen.example", true, "http://xn--mnchen-3ya.example/"},
+		{"MÜNCHEN.example:8080", true, "http://xn--mnchen-psa.example:8080/"},
+		{"bücher.münchen.example:80", true, "http://xn--bcher-kva.xn--mnchen-3ya.example/"},
+		{"example.com", true, "http://example.com/"},
+		{"münchen.example.", true, "http://xn--mnchen-3ya.example./"},
+		{"ＥＸＡＭＰＬＥ.com", true, "http://xn--ph7chab1aes7c.com/"},
+		{"x\u200dy.example", true, "http://xn--xy-m1t.example/"},
+		{"münchen\u3002example", true, "http://xn--mnchenexample-wob9861p/"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Host = tt.host
+
+		out, err := baseStringURI(req, &Normalization{PunycodeHost: tt.punycode})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. baseStringURI %v\nhave %s\nwant %s", i, tt.host, out, tt.out)
+		}
+	}
+}
+
+func TestBaseStringURIPunycodeInvalid(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Host = "m\xfcnchen.example"
+
+	_, err = baseStringURI(req, &Normalization{PunycodeHost: true})
+	if err == nil {
+		t.Errorf("baseStringURI should reject a host that is not valid UTF-8")
+	}
+}
+
+func TestBaseStringURIPunycodeSent(t *testing.T) {
+	var tests = []string{
+		"münchen.example",
+		"MÜNCHEN.example:8080",
+		"bücher.münchen.example",
+		"ＥＸＡＭＰＬＥ.com",
+		"x\u200dy.example",
+		"münchen\u3002example",
+	}
+
+	// The server computes the base string URI from the Host header as
+	// sent by the net/http package.
+	hosts := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri, err := baseStringURI(r, nil)
+		if err != nil {
+			uri = err.Error()
+		}
+
+		hosts <- uri
+	}))
+	defer ts.Close()
+
+	for i, host := range tests {
+		req, err := http.NewRequest("GET", ts.URL+"/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Host = host
+
+		out, err := baseStringURI(req, &Normalization{PunycodeHost: true})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		resp.Body.Close()
+
+		if sent := <-hosts; out != sent {
+			t.Errorf("%d. baseStringURI %v\nhave %s\nwant %s", i, host, out, sent)
+		}
+	}
+}
+
+func TestBaseStringURIOpaque(t *testing.T) {
+	var tests = []struct {
+		// in
+		host   string
+		opaque string
+
+		// out
+		out string
+		err error
+	}{
+		{"example.com", "//example.com/r%2Fv/X", "http://example.com/r%2Fv/X", nil},
+		{"", "//EXAMPLE.COM:80/r%2Fv", "http://example.com/r%2Fv", nil},
+		{"example.com", "/r%2Fv/X", "http://example.com/r%2Fv/X", nil},
+		{"", "example.com/r%2Fv/X", "", errOpaqueURL},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/?id=123", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Host = tt.host
+		req.URL.Host = ""
+		req.URL.Opaque = tt.opaque
+
+		out, err := baseStringURI(req, nil)
+		if err != tt.err {
+			t.Errorf("%d. baseStringURI %v\nhave %v\nwant %v", i, tt.opaque, err, tt.err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. baseStringURI %v\nhave %s\nwant %s", i, tt.opaque, out, tt.out)
+		}
+	}
+}
+
+func TestBaseStringURITrailingDot(t *testing.T) {
+	var tests = []struct {
+		// in
+		url             string
+		trimTrailingDot bool
+
+		// out
+		out string
+	}{
+		{"http://example.com./r", false, "http://example.com./r"},
+		{"http://example.com./r", true, "http://example.com/r"},
+		{"http://example.com.:8080/r", true, "http://example.com:8080/r"},
+		{"https://example.com.:443/r", true, "https://example.com/r"},
+		{"http://example.com/r", true, "http://example.com/r"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		out, err := baseStringURI(req, &Normalization{TrimTrailingDot: tt.trimTrailingDot})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. baseStringURI %v\nhave %s\nwant %s", i, tt.url, out, tt.out)
+		}
+	}
+}
+
 func TestCollectParameters(t *testing.T) {
 	url := "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b"
 	body := strings.NewReader("c2&a3=2+q")
@@ -86,7 +447,7 @@ func TestCollectParameters(t *testing.T) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Authorization", authorizationHeader)
 
-	values, err := collectParameters(req, nil)
+	values, err := collectParameters(req, nil, nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
@@ -108,49 +469,702 @@ func TestCollectParameters(t *testing.T) {
 	}
 }
 
-func TestNormalizeParameters(t *testing.T) {
-	params := url.Values{}
-	params.Add("b5", "=%3D")
-	params.Add("a3", "a")
-	params.Add("c@", "")
-	params.Add("a2", "r b")
-	params.Add("oauth_consumer_key", "9djdj82h48djs9d2")
-	params.Add("oauth_token", "kkk9d7dh3k39sjv7")
-	params.Add("oauth_signature_method", "HMAC-SHA1")
-	params.Add("oauth_timestamp", "137131201")
-	params.Add("oauth_nonce", "7d8f3e4a")
-	params.Add("c2", "")
-	params.Add("a3", "2 q")
-
-	expected := "" +
-		"a2=r%20b&a3=2%20q&a3=a&b5=%3D%253D&c%40=&c2=&oauth_consumer_key=9dj" +
-		"dj82h48djs9d2&oauth_nonce=7d8f3e4a&oauth_signature_method=HMAC-SHA1" +
-		"&oauth_timestamp=137131201&oauth_token=kkk9d7dh3k39sjv7"
-
-	out := normalizeParameters(params)
-	if out != expected {
-		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
-	}
-}
-
-func TestParseAuthorizationHeader(t *testing.T) {
-	req, err := http.NewRequest("GET", "http://example.com/", nil)
+func TestCollectParametersQueryOnce(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/request?a=1", strings.NewReader("b=2"))
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
-	req.Header.Set("Authorization", authorizationHeader)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	values, err := parseAuthorizationHeader(req)
+	out, err := signatureBase(req, nil, nil)
 	if err != nil {
 		t.Fatalf("unexpected error %v", err)
 	}
 
-	if v := values.Get("oauth_token"); v != "kkk9d7dh3k39sjv7" {
-		t.Errorf("oauth_token\nhave %s\nwant %s", v, "kkk9d7dh3k39sjv7")
+	expected := "POST&http%3A%2F%2Fexample.com%2Frequest&a%3D1%26b%3D2"
+	if out != expected {
+		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
 	}
+}
 
-	if _, ok := values["realm"]; ok {
-		t.Errorf("realm should be excluded")
+func TestCollectParametersQueryAndBody(t *testing.T) {
+	var tests = []struct {
+		// in
+		query string
+		body  string
+
+		// out
+		out string
+	}{
+		{"x=1", "x=2", "POST&http%3A%2F%2Fexample.com%2Frequest&x%3D1%26x%3D2"},
+		{"x=2", "x=1", "POST&http%3A%2F%2Fexample.com%2Frequest&x%3D1%26x%3D2"},
+		{"x=2&x=1", "x=1", "POST&http%3A%2F%2Fexample.com%2Frequest&x%3D1%26x%3D1%26x%3D2"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/request?"+tt.query, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		out, err := signatureBase(req, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. signatureBase\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
+func TestParameters(t *testing.T) {
+	url := "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b"
+	expected := []Parameter{
+		{"a2", "r b"},
+		{"a3", "2 q"},
+		{"a3", "a"},
+		{"b5", "=%3D"},
+		{"c@", ""},
+		{"c2", ""},
+		{"oauth_consumer_key", "9djdj82h48djs9d2"},
+		{"oauth_nonce", "7d8f3e4a"},
+		{"oauth_signature_method", "HMAC-SHA1"},
+		{"oauth_timestamp", "137131201"},
+		{"oauth_token", "kkk9d7dh3k39sjv7"},
+	}
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("POST", url, strings.NewReader("c2&a3=2+q"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", authorizationHeader)
+
+		out, err := Parameters(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if !reflect.DeepEqual(out, expected) {
+			t.Fatalf("%d. incorrect\nhave %v\nwant %v", i, out, expected)
+		}
+	}
+}
+
+func TestNormalizeParameters(t *testing.T) {
+	params := url.Values{}
+	params.Add("b5", "=%3D")
+	params.Add("a3", "a")
+	params.Add("c@", "")
+	params.Add("a2", "r b")
+	params.Add("oauth_consumer_key", "9djdj82h48djs9d2")
+	params.Add("oauth_token", "kkk9d7dh3k39sjv7")
+	params.Add("oauth_signature_method", "HMAC-SHA1")
+	params.Add("oauth_timestamp", "137131201")
+	params.Add("oauth_nonce", "7d8f3e4a")
+	params.Add("c2", "")
+	params.Add("a3", "2 q")
+
+	expected := "" +
+		"a2=r%20b&a3=2%20q&a3=a&b5=%3D%253D&c%40=&c2=&oauth_consumer_key=9dj" +
+		"dj82h48djs9d2&oauth_nonce=7d8f3e4a&oauth_signature_method=HMAC-SHA1" +
+		"&oauth_timestamp=137131201&oauth_token=kkk9d7dh3k39sjv7"
+
+	out := normalizeParameters(params)
+	if out != expected {
+		t.Errorf("incorrect\nhave %s\nwant %s", out, expected)
+	}
+}
+
+func TestNormalizeParametersEncodedSort(t *testing.T) {
+	var tests = []struct {
+		// in
+		params url.Values
+
+		// out
+		out string
+	}{
+		// A tilde is unreserved and sorts after the encoded space.
+		{url.Values{"a~": {"1"}, "a ": {"2"}}, "a%20=2&a~=1"},
+		// The raw names sort z before |, but the encoded | begins with %.
+		{url.Values{"cz": {"1"}, "c|": {"2"}}, "c%7C=2&cz=1"},
+		// Values with the same name are also sorted by their encoded form.
+		{url.Values{"c": {"z", "|", "~"}}, "c=%7C&c=z&c=~"},
+	}
+
+	for i, tt := range tests {
+		out := normalizeParameters(tt.params)
+		if out != tt.out {
+			t.Errorf("%d. normalizeParameters\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
+// naiveNormalizeParameters is the straightforward implementation of
+// normalizeParameters that it must agree with.
+func naiveNormalizeParameters(in url.Values) string {
+	params := make(url.Values, len(in))
+	for k, vs := range in {
+		params[encode(k)] = vs
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+
+	rv := ""
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := make([]string, 0, len(params[k]))
+		for _, v := range params[k] {
+			values = append(values, encode(v))
+		}
+
+		sort.Strings(values)
+		for _, v := range values {
+			if len(rv) > 0 {
+				rv += "&"
+			}
+			rv += k + "=" + v
+		}
+	}
+
+	return rv
+}
+
+func benchmarkParameters() url.Values {
+	params := testParameters()
+	params.Set("oauth_signature_method", "HMAC-SHA1")
+	for i := 0; i < 20; i++ {
+		params.Add("p"+strconv.Itoa(i%7), "value "+strconv.Itoa(i)+"/~!*")
+	}
+
+	return params
+}
+
+func TestNormalizeParametersNaive(t *testing.T) {
+	var tests = []url.Values{
+		nil,
+		{},
+		{"a": {}},
+		{"a": {"", ""}},
+		{"a~": {"1"}, "a ": {"2"}},
+		{"c": {"z", "|", "~"}, "cz": {"1"}, "c|": {"2"}},
+		benchmarkParameters(),
+	}
+
+	for i, params := range tests {
+		out := normalizeParameters(params)
+		expected := naiveNormalizeParameters(params)
+		if out != expected {
+			t.Errorf("%d. normalizeParameters\nhave %s\nwant %s", i, out, expected)
+		}
+	}
+}
+
+func BenchmarkNormalizeParameters(b *testing.B) {
+	params := benchmarkParameters()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		normalizeParameters(params)
+	}
+}
+
+func BenchmarkNormalizeParametersNaive(b *testing.B) {
+	params := benchmarkParameters()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		naiveNormalizeParameters(params)
+	}
+}
+
+func TestParseAuthorizationHeader(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Authorization", authorizationHeader)
+
+	values, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := values.Get("oauth_token"); v != "kkk9d7dh3k39sjv7" {
+		t.Errorf("oauth_token\nhave %s\nwant %s", v, "kkk9d7dh3k39sjv7")
+	}
+
+	if _, ok := values["realm"]; ok {
+		t.Errorf("realm should be excluded")
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Authorization", authorizationHeader)
+
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	header, err := AuthorizationHeader(params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Authorization", header)
+
+	out, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !reflect.DeepEqual(out, params) {
+		t.Errorf("incorrect\nhave %v\nwant %v", out, params)
+	}
+
+	params.Del("oauth_signature")
+	_, err = AuthorizationHeader(params)
+	if err != ErrMissingSignature {
+		t.Errorf("missing oauth_signature\nhave %v\nwant %v", err, ErrMissingSignature)
+	}
+
+	header, err = AuthorizationHeader(url.Values{"oauth_signature": {"x"}, "oauth_token": {}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if header != `OAuth oauth_signature="x"` {
+		t.Errorf("empty oauth_token\nhave %s\nwant %s", header, `OAuth oauth_signature="x"`)
+	}
+}
+
+func TestValidateAuthorizationHeader(t *testing.T) {
+	var tests = []struct {
+		// in
+		header string
+
+		// out
+		missing   []string
+		malformed []string
+	}{
+		{authorizationHeader, nil, nil},
+		{`OAuth realm="Photo Prints", oauth_consumer_key="dpf43f3p2l4k3l03", oauth_signature_method="PLAINTEXT", oauth_signature="kd94hf93k423kf44%26"`, nil, nil},
+		{`OAuth oauth_consumer_key="9djdj82h48djs9d2", oauth_signature_method="HMAC-SHA1"`, []string{"oauth_signature", "oauth_timestamp", "oauth_nonce"}, nil},
+		{`OAuth oauth_consumer_key=9djdj82h48djs9d2, oauth_signature_method="HMAC-SHA1", oauth_timestamp="137131201", oauth_nonce="7d8f3e4a", oauth_signature="bYT5CMsGcbgUdFHObYMEfcx6bsw="`, nil, []string{"oauth_consumer_key", "oauth_signature"}},
+		{authorizationHeader + ",", nil, nil},
+		{"OAuth ", []string{"oauth_consumer_key", "oauth_signature_method", "oauth_signature", "oauth_timestamp", "oauth_nonce"}, nil},
+		{`OAuth ="dpf43f3p2l4k3l03", oauth_signature_method="PLAINTEXT", oauth_signature="kd94hf93k423kf44%26"`, []string{"oauth_consumer_key"}, []string{`="dpf43f3p2l4k3l03"`}},
+		{`OAuth oauth_consumer_key="9djdj82h48djs9d2", oauth_signature_method="HMAC-SHA1", oauth_timestamp="12.5", oauth_nonce="7d8f3e4a", oauth_nonce="7d8f3e4b", oauth_version="2.0", oauth_signature="bYT5CMsGcbgUdFHObYMEfcx6bsw%3D"`, nil, []string{"oauth_nonce", "oauth_timestamp", "oauth_version"}},
+	}
+
+	for i, tt := range tests {
+		err := ValidateAuthorizationHeader(tt.header)
+		if tt.missing == nil && tt.malformed == nil {
+			if err != nil {
+				t.Errorf("%d. unexpected error %v", i, err)
+			}
+
+			continue
+		}
+
+		e, ok := err.(*AuthorizationHeaderError)
+		if !ok {
+			t.Errorf("%d. ValidateAuthorizationHeader\nhave %v\nwant *AuthorizationHeaderError", i, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(e.Missing, tt.missing) {
+			t.Errorf("%d. Missing\nhave %v\nwant %v", i, e.Missing, tt.missing)
+		}
+
+		if !reflect.DeepEqual(e.Malformed, tt.malformed) {
+			t.Errorf("%d. Malformed\nhave %v\nwant %v", i, e.Malformed, tt.malformed)
+		}
+	}
+
+	err := ValidateAuthorizationHeader("Bearer mF_9.B5f-4.1JqM")
+	if err != errAuthHeaderParam {
+		t.Errorf("ValidateAuthorizationHeader\nhave %v\nwant %v", err, errAuthHeaderParam)
+	}
+}
+
+func TestMakeAuthorizationHeaderOrder(t *testing.T) {
+	params := url.Values{
+		"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+		"oauth_token":            {"nnch734d00sl2jdk"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"137131202"},
+		"oauth_nonce":            {"chapoH"},
+		"oauth_version":          {"1.0"},
+		"oauth_signature":        {"MdpQcU8iPSUjWoN/UDMsK2sui9I="},
+		"oauth_verifier":         {"hfdp7dh39dks9884"},
+	}
+
+	var tests = []struct {
+		// in
+		conventional bool
+
+		// out
+		out string
+	}{
+		{false, `OAuth oauth_consumer_key="dpf43f3p2l4k3l03",oauth_nonce="chapoH",oauth_signature="MdpQcU8iPSUjWoN%2FUDMsK2sui9I%3D",oauth_signature_method="HMAC-SHA1",oauth_timestamp="137131202",oauth_token="nnch734d00sl2jdk",oauth_verifier="hfdp7dh39dks9884",oauth_version="1.0"`},
+		{true, `OAuth oauth_consumer_key="dpf43f3p2l4k3l03",oauth_token="nnch734d00sl2jdk",oauth_signature_method="HMAC-SHA1",oauth_timestamp="137131202",oauth_nonce="chapoH",oauth_version="1.0",oauth_verifier="hfdp7dh39dks9884",oauth_signature="MdpQcU8iPSUjWoN%2FUDMsK2sui9I%3D"`},
+	}
+
+	for i, tt := range tests {
+		out := makeAuthorizationHeader(params, tt.conventional)
+		if out != tt.out {
+			t.Errorf("%d. makeAuthorizationHeader\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
+func TestParseAuthorizationHeaderQuotedComma(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Authorization", `OAuth realm="Photos, Inc.", oauth_token="kkk9d7dh3k39sjv7", x_note="a,b"`)
+
+	values, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := values.Get("oauth_token"); v != "kkk9d7dh3k39sjv7" {
+		t.Errorf("oauth_token\nhave %s\nwant %s", v, "kkk9d7dh3k39sjv7")
+	}
+
+	if v := values.Get("x_note"); v != "a,b" {
+		t.Errorf("x_note\nhave %s\nwant %s", v, "a,b")
+	}
+
+	if len(values) != 2 {
+		t.Errorf("incorrect number of parameters\nhave %d\nwant %d", len(values), 2)
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	var tests = []string{
+		"file=vacation.jpg&size=original",
+		"a=1&a=2&&b&c=",
+		"a=1;b=2&c=3",
+		"a=%zz&b=%2a&c=a+b",
+		"=1&%3D=2",
+		"",
+	}
+
+	for i, tt := range tests {
+		form, err := parseForm(strings.NewReader(tt))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		want, _ := url.ParseQuery(tt)
+		if !reflect.DeepEqual(form, want) {
+			t.Errorf("%d. parseForm\nhave %v\nwant %v", i, form, want)
+		}
+	}
+}
+
+func TestParseAuthorizationHeaderSpaceSeparated(t *testing.T) {
+	var tests = []struct {
+		// in
+		spaceSeparatedHeader bool
+
+		// out
+		err error
+	}{
+		{false, errAuthHeaderParam},
+		{true, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Authorization", `OAuth realm="Photos Inc" oauth_consumer_key="9djdj82h48djs9d2"  oauth_token="kkk9d7dh3k39sjv7"`)
+
+		values, err := parseAuthorizationHeader(req, &Normalization{SpaceSeparatedHeader: tt.spaceSeparatedHeader})
+		if err != tt.err {
+			t.Errorf("%d. parseAuthorizationHeader\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if v := values.Get("oauth_token"); v != "kkk9d7dh3k39sjv7" {
+			t.Errorf("%d. oauth_token\nhave %s\nwant %s", i, v, "kkk9d7dh3k39sjv7")
+		}
+
+		if len(values) != 2 {
+			t.Errorf("%d. incorrect number of parameters\nhave %d\nwant %d", i, len(values), 2)
+		}
+	}
+}
+
+func TestSignatureBaseSpaces(t *testing.T) {
+	var tests = []struct {
+		// in
+		source string
+		query  string
+		body   string
+		header string
+	}{
+		{"query", "?q=a+b", "", ""},
+		{"query", "?q=a%20b", "", ""},
+		{"body", "", "q=a+b", ""},
+		{"body", "", "q=a%20b", ""},
+		{"header", "", "", `OAuth q="a%20b"`},
+	}
+
+	for i, tt := range tests {
+		url := "http://example.com/request" + tt.query
+		req, err := http.NewRequest("POST", url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		out, err := signatureBase(req, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if !strings.HasSuffix(out, "&q%3Da%2520b") {
+			t.Errorf("%d. %s space should be encoded as %%20\nhave %s", i, tt.source, out)
+		}
+
+		if strings.Contains(out, "+") {
+			t.Errorf("%d. %s space should not be encoded as +\nhave %s", i, tt.source, out)
+		}
+	}
+}
+
+func TestSignatureBasePlus(t *testing.T) {
+	var tests = []struct {
+		// in
+		literalPlus bool
+
+		// out
+		out string
+	}{
+		{false, "GET&http%3A%2F%2Fexample.com%2Frequest&q%3Da%2520b%26r%3Dc%2520d"},
+		{true, "GET&http%3A%2F%2Fexample.com%2Frequest&q%3Da%252Bb%26r%3Dc%2520d"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/request?q=a+b&r=c%20d", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		out, err := signatureBase(req, nil, &Normalization{LiteralPlus: tt.literalPlus})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. incorrect\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
+func TestEncodeByteRange(t *testing.T) {
+	const unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.~"
+	for i := 0; i < 256; i++ {
+		c := byte(i)
+		out := encode(string([]byte{c}))
+
+		expected := fmt.Sprintf("%%%02X", c)
+		if strings.IndexByte(unreserved, c) >= 0 {
+			expected = string([]byte{c})
+		}
+
+		if out != expected {
+			t.Errorf("%d. encode\nhave %s\nwant %s", i, out, expected)
+		}
+	}
+}
+
+func TestSignatureBaseControlBytes(t *testing.T) {
+	params := url.Values{"note": {"a\x00b\nc"}}
+	if out := normalizeParameters(params); out != "note=a%00b%0Ac" {
+		t.Errorf("normalizeParameters\nhave %q\nwant %q", out, "note=a%00b%0Ac")
+	}
+
+	out, err := BaseString("POST", "http://example.com/request", params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "POST&http%3A%2F%2Fexample.com%2Frequest&note%3Da%2500b%250Ac"
+	if out != expected {
+		t.Errorf("incorrect\nhave %q\nwant %q", out, expected)
+	}
+
+	req, err := testTransport.NewRequest(context.Background(), "POST", "http://example.com/request", strings.NewReader(params.Encode()))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSignatureBaseValuesEncode(t *testing.T) {
+	query := url.Values{"q": {"sunset beach"}, "a": {"1+1"}}.Encode()
+	if query != "a=1%2B1&q=sunset+beach" {
+		t.Fatalf("url.Values.Encode\nhave %s\nwant %s", query, "a=1%2B1&q=sunset+beach")
+	}
+
+	var tests = []struct {
+		// in
+		literalPlus bool
+
+		// out
+		out string
+	}{
+		{false, "GET&http%3A%2F%2Fexample.com%2Frequest&a%3D1%252B1%26q%3Dsunset%2520beach"},
+		{true, "GET&http%3A%2F%2Fexample.com%2Frequest&a%3D1%252B1%26q%3Dsunset%252Bbeach"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/request?"+query, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		out, err := signatureBase(req, nil, &Normalization{LiteralPlus: tt.literalPlus})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. incorrect\nhave %s\nwant %s", i, out, tt.out)
+		}
+	}
+}
+
+func TestSignatureBaseAmpersand(t *testing.T) {
+	var tests = []struct {
+		// in
+		method string
+		query  string
+		body   string
+	}{
+		{"GET", "a=b%26c", ""},
+		{"POST", "", "a=b%26c"},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), tt.method, "http://example.com/request?"+tt.query, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params, err := collectParameters(req, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if v := params["a"]; len(v) != 1 || v[0] != "b&c" {
+			t.Errorf("%d. parameter should not be split\nhave %v", i, v)
+		}
+
+		base, err := SignatureBaseString(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if !strings.Contains(base, "&a%3Db%2526c%26") {
+			t.Errorf("%d. ampersand should be encoded as %%26\nhave %s", i, base)
+		}
+
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestSignatureBaseSemicolon(t *testing.T) {
+	var tests = []struct {
+		// in
+		semicolon bool
+
+		// out
+		out string
+	}{
+		{false, "POST&http%3A%2F%2Fexample.com%2Frequest&a%3D1%253Bb%253D2%26c%3D3%26d%3D4"},
+		{true, "POST&http%3A%2F%2Fexample.com%2Frequest&a%3D1%26b%3D2%26c%3D3%26d%3D4"},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/request?a=1;b=2&c=3", strings.NewReader("d=4"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		n := &Normalization{SemicolonSeparator: tt.semicolon}
+		out, err := signatureBase(req, nil, n)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if out != tt.out {
+			t.Errorf("%d. incorrect\nhave %s\nwant %s", i, out, tt.out)
+		}
+
+		if req.URL.RawQuery != "a=1;b=2&c=3" {
+			t.Errorf("%d. query should not be modified\nhave %s", i, req.URL.RawQuery)
+		}
+
+		req, err = http.NewRequest("POST", "http://example.com/request?a=1;b=2&c=3", strings.NewReader("d=4"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		tr := *testTransport
+		tr.Normalization = *n
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.Normalization = *n
+		err = v.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
 	}
 }
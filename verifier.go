@@ -0,0 +1,946 @@
+package oauth1
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Verifier verifies the signature of authenticated requests received by a
+// server.
+//
+// Example usage:
+//
+//	v := oauth1.Verifier{
+//		ConsumerSecret: func(key string) ([]string, error) {
+//			return db.ConsumerSecrets(key)
+//		},
+//		TokenSecret: func(token string) ([]string, error) {
+//			return db.TokenSecrets(token)
+//		},
+//	}
+//
+//	err := v.Verify(req)
+//	if err != nil {
+//		http.Error(w, err.Error(), http.StatusUnauthorized)
+//		return
+//	}
+type Verifier struct {
+	// ConsumerSecret returns the shared secrets for the given consumer key.
+	// More than one secret may be returned while a secret is being rotated,
+	// in which case a signature matching any of them is accepted.
+	ConsumerSecret func(key string) ([]string, error)
+
+	// TokenSecret returns the secrets for the given token. As with the
+	// ConsumerSecret, more than one secret may be returned while a secret is
+	// being rotated.
+	TokenSecret func(token string) ([]string, error)
+
+	// AllowTwoLegged permits requests without an oauth_token. These requests
+	// are signed with the consumer secret and an empty token secret. An
+	// oauth_token that is present but empty is treated as missing, though
+	// it remains part of the signature base string.
+	AllowTwoLegged bool
+
+	// MinNonceEntropy, if positive, rejects requests with an oauth_nonce
+	// whose estimated entropy is less than MinNonceEntropy bits. The
+	// estimate is the length of the nonce multiplied by the entropy of the
+	// frequencies of its characters, so a nonce that is short or repeats
+	// few characters is rejected. It is a defense against trivially guessed
+	// nonces rather than a measure of randomness; a counter, for example,
+	// is not detected. The nonce may be omitted with the PLAINTEXT signature
+	// method.
+	//
+	// See RFC 5849 Section 3.3.
+	MinNonceEntropy float64
+
+	// Nonces, if not nil, records the oauth_nonce of each request with a
+	// valid signature and rejects a request that reuses a nonce with
+	// ErrNonceReused. Nonces are recorded only for valid signatures so that
+	// forged requests cannot exhaust them.
+	//
+	// See RFC 5849 Section 3.3.
+	Nonces NonceStore
+
+	// RequireTLS rejects all requests that were not received over TLS,
+	// either directly or by one of the TrustedProxies.
+	RequireTLS bool
+
+	// RequirePlaintextTLS rejects PLAINTEXT signatures on requests that were
+	// not received over TLS directly, since the signature exposes the
+	// secrets. The X-Forwarded-Proto header is not considered.
+	//
+	// See RFC 5849 Section 3.4.4.
+	RequirePlaintextTLS bool
+
+	// TrustedProxies lists the IP addresses and CIDR ranges, such as
+	// "10.0.0.1" or "10.0.0.0/8", of the proxies trusted to report the scheme
+	// and host of a request with the X-Forwarded-Proto and X-Forwarded-Host
+	// headers. These are used for RequireTLS and the base string URI. The
+	// headers are ignored on requests from any other RemoteAddr, and on all
+	// requests if TrustedProxies is empty, in favor of the values of the
+	// direct connection. Malformed entries are ignored.
+	TrustedProxies []string
+
+	// MaxParameters limits the number of parameters that are collected from
+	// a request to guard against the cost of normalizing an excessive number
+	// of parameters. A MaxParameters of zero means no limit.
+	MaxParameters int
+
+	// ConsumerKeys, if not nil, is the set of known consumer keys. Requests
+	// from any other consumer are rejected before their secrets are looked
+	// up or their signatures computed.
+	ConsumerKeys map[string]bool
+
+	// AssumeHMACSHA1 verifies requests without an oauth_signature_method as
+	// if they were signed with HMAC-SHA1, as some clients assume. RFC 5849
+	// Section 3.1 requires the parameter, so these requests are otherwise
+	// rejected with ErrUnsupportedSignatureMethod.
+	AssumeHMACSHA1 bool
+
+	// HMACHashes maps additional HMAC signature method names, such as
+	// HMAC-SHA512, to their hash functions. The signature is computed as for
+	// HMAC-SHA1 using the given hash. HMAC-SHA1 and PLAINTEXT are always
+	// supported.
+	HMACHashes map[string]func() hash.Hash
+
+	// SingleLocation rejects requests with protocol parameters in more than
+	// one of the Authorization header, query and form body. RFC 5849
+	// Section 3.5 permits the parameters to be distributed, but a server may
+	// require all of them to be sent using a single method.
+	SingleLocation bool
+
+	// ValidateConsumerKey and ValidateToken, if not nil, are called with the
+	// oauth_consumer_key and oauth_token before their secrets are looked up.
+	// A non-nil error rejects the request, which allows identifiers that do
+	// not match the expected format to be rejected early.
+	ValidateConsumerKey func(key string) error
+	ValidateToken       func(token string) error
+
+	// Normalization configures deviations from RFC 5849 made when
+	// constructing the signature base string.
+	Normalization Normalization
+
+	// Rewrite, if not nil, is called with a copy of the request before the
+	// base string URI is computed, after the scheme and host reported by any
+	// of the TrustedProxies have been applied. It may be used to restore the URL signed
+	// by the client when the request has been altered by a proxy or load
+	// balancer, such as by removing a path prefix.
+	Rewrite func(req *http.Request)
+
+	// AllowRawQuery also accepts signatures computed over the query exactly
+	// as it appears in the request URI, without decoding and re-encoding
+	// the query parameters. Some clients erroneously sign requests this
+	// way. The conformant base string is always tried first.
+	AllowRawQuery bool
+
+	// Debug returns a *SignatureMismatchError in place of
+	// ErrInvalidSignature. It should not be enabled in production since the
+	// error describes how the expected signature was computed.
+	Debug bool
+}
+
+// NonceStore records the nonces of requests received by a Verifier to detect
+// replayed requests.
+type NonceStore interface {
+	// Seen records the nonce and timestamp of a request from the consumer
+	// and returns true if they were already recorded for the same consumer
+	// key. Nonces are namespaced by the consumer key, so the same nonce from
+	// another consumer has not been seen.
+	Seen(consumerKey, nonce, timestamp string) (bool, error)
+}
+
+// SignatureMismatchError describes an invalid signature. It is returned in
+// place of ErrInvalidSignature when the Verifier is in Debug mode.
+type SignatureMismatchError struct {
+	// Computed is the expected signature. It is empty for the PLAINTEXT
+	// signature method since the signature is made from the secrets.
+	Computed string
+
+	// Received is the signature sent with the request.
+	Received string
+
+	// BaseString is the signature base string used to compute the expected
+	// signature. It is empty for the PLAINTEXT signature method.
+	BaseString string
+}
+
+func (e *SignatureMismatchError) Error() string {
+	return ErrInvalidSignature.Error() + ": computed " + e.Computed + " from " + e.BaseString + ", received " + e.Received
+}
+
+var (
+	ErrTooManyParameters          = errors.New("too many parameters")
+	ErrDuplicateParameter         = errors.New("duplicate protocol parameter")
+	ErrMixedParameterLocations    = errors.New("protocol parameters in more than one location")
+	ErrUnsupportedVersion         = errors.New("unsupported oauth_version")
+	ErrMissingConsumerKey         = errors.New("missing oauth_consumer_key")
+	ErrUnknownConsumerKey         = errors.New("unknown oauth_consumer_key")
+	ErrMissingToken               = errors.New("missing oauth_token")
+	ErrUnsupportedSignatureMethod = errors.New("unsupported oauth_signature_method")
+	ErrMalformedTimestamp         = errors.New("malformed oauth_timestamp")
+	ErrMissingNonce               = errors.New("missing oauth_nonce")
+	ErrWeakNonce                  = errors.New("oauth_nonce has insufficient entropy")
+	ErrNonceReused                = errors.New("oauth_nonce has already been used")
+	ErrMissingSignature           = errors.New("missing oauth_signature")
+	ErrMalformedEncoding          = errors.New("malformed percent encoding")
+	ErrMalformedSignature         = errors.New("malformed oauth_signature")
+	ErrInvalidSignature           = errors.New("invalid oauth_signature")
+	ErrInsecurePlaintext          = errors.New("PLAINTEXT signature requires TLS")
+	ErrInsecureTransport          = errors.New("request requires TLS")
+)
+
+// Verify returns nil if the request carries a valid signature. A form body
+// is restored so that it may be read again by the handler. A body that
+// implements io.Seeker is parsed in place and rewound to its original
+// offset, otherwise it is buffered in memory. Other bodies are not read
+// since they are not signed.
+//
+// See RFC 5849 Section 3.2.
+func (v *Verifier) Verify(req *http.Request) error {
+	return v.verifyRequest(req, nil)
+}
+
+// verifyRequest is like Verify but also compares the signature base string
+// with expected if it is not nil.
+func (v *Verifier) verifyRequest(req *http.Request, expected *string) error {
+	if body, ok := req.Body.(io.ReadSeeker); ok {
+		offset, err := body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		err = v.verify(req, body, expected)
+		if _, serr := body.Seek(offset, io.SeekStart); serr != nil {
+			return serr
+		}
+
+		return err
+	}
+
+	body, err := readForm(req)
+	if err != nil {
+		return err
+	}
+
+	return v.verify(req, bytes.NewReader(body), expected)
+}
+
+// VerifyAll verifies each of the requests and returns the result of each at
+// the same index. Secrets are looked up once for each consumer key and token
+// in the batch.
+func (v *Verifier) VerifyAll(reqs []*http.Request) []error {
+	type consumer struct {
+		secrets []string
+		err     error
+	}
+
+	type token struct {
+		secrets []string
+		err     error
+	}
+
+	consumers := make(map[string]consumer)
+	tokens := make(map[string]token)
+
+	c := *v
+	c.ConsumerSecret = func(key string) ([]string, error) {
+		rv, ok := consumers[key]
+		if !ok {
+			rv.secrets, rv.err = v.ConsumerSecret(key)
+			consumers[key] = rv
+		}
+
+		return rv.secrets, rv.err
+	}
+
+	c.TokenSecret = func(key string) ([]string, error) {
+		rv, ok := tokens[key]
+		if !ok {
+			rv.secrets, rv.err = v.TokenSecret(key)
+			tokens[key] = rv
+		}
+
+		return rv.secrets, rv.err
+	}
+
+	errs := make([]error, len(reqs))
+	for i, req := range reqs {
+		errs[i] = c.Verify(req)
+	}
+
+	return errs
+}
+
+// VerifyBody is like Verify but collects the entity body parameters from
+// body rather than the request body. This is useful when the request body
+// has already been read by another handler.
+//
+// See RFC 5849 Section 3.2.
+func (v *Verifier) VerifyBody(req *http.Request, body []byte) error {
+	return v.verify(req, bytes.NewReader(body), nil)
+}
+
+// VerifyComponents is like VerifyBody for a request given by its method,
+// absolute URL, headers and entity body rather than an *http.Request, such
+// as the event delivered to a serverless function by an API gateway. The
+// body must already be decoded if the gateway encodes it, such as with
+// base64. The Host header, if present, takes precedence over the host of
+// the URL, and a URL with the https scheme is treated as received over TLS.
+//
+// See RFC 5849 Section 3.2.
+func (v *Verifier) VerifyComponents(method, rawurl string, header http.Header, body []byte) error {
+	req, err := http.NewRequest(method, rawurl, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	if header != nil {
+		req.Header = header
+	}
+
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	if strings.EqualFold(req.URL.Scheme, "https") {
+		req.TLS = &tls.ConnectionState{}
+	}
+
+	return v.VerifyBody(req, body)
+}
+
+// verify returns nil if the request carries a valid signature, collecting
+// the entity body parameters from body. The signature base string is
+// compared with expected before the signature if it is not nil.
+func (v *Verifier) verify(req *http.Request, body io.Reader, expected *string) error {
+	if v.RequireTLS && !v.isSecure(req) {
+		return ErrInsecureTransport
+	}
+
+	// The Authorization header, query and form body are each parsed once
+	// and the request is only copied if it is to be rewritten.
+	values, err := parseRequest(req, body, &v.Normalization)
+	if err != nil {
+		return err
+	}
+
+	params := values.all(&v.Normalization)
+	if v.MaxParameters > 0 {
+		n := 0
+		for _, vs := range params {
+			n += len(vs)
+		}
+
+		if n > v.MaxParameters {
+			return ErrTooManyParameters
+		}
+	}
+
+	// Protocol parameters may be spread across the Authorization header,
+	// query and entity body but must not be repeated.
+	for k, vs := range params {
+		if strings.HasPrefix(k, "oauth_") && len(vs) > 1 {
+			return ErrDuplicateParameter
+		}
+	}
+
+	if v.SingleLocation {
+		n := 0
+		for _, values := range []url.Values{values.header, values.query, values.form} {
+			if hasProtocolParameters(values) {
+				n++
+			}
+		}
+
+		if n > 1 {
+			return ErrMixedParameterLocations
+		}
+	}
+
+	if _, ok := params["oauth_version"]; ok && params.Get("oauth_version") != "1.0" {
+		return ErrUnsupportedVersion
+	}
+
+	signature := params.Get("oauth_signature")
+	params.Del("oauth_signature")
+
+	// The base string is computed at most once, here only when it is to be
+	// compared with the expected base string.
+	var bases []string
+	if expected != nil {
+		bases, err = v.baseStrings(req, params)
+		if err != nil {
+			return err
+		}
+
+		if bases[0] != *expected {
+			return &BaseStringMismatchError{Computed: bases[0], Expected: *expected}
+		}
+	}
+
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	// The PLAINTEXT signature method is the only one without a hash.
+	var newHash func() hash.Hash
+	method := params.Get("oauth_signature_method")
+	if method == "" && v.AssumeHMACSHA1 {
+		method = "HMAC-SHA1"
+	}
+
+	switch method {
+	case "HMAC-SHA1":
+		newHash = sha1.New
+	case "PLAINTEXT":
+		if v.RequirePlaintextTLS && req.TLS == nil {
+			return ErrInsecurePlaintext
+		}
+	default:
+		newHash = v.HMACHashes[method]
+		if newHash == nil {
+			return ErrUnsupportedSignatureMethod
+		}
+	}
+
+	err = checkTimestamp(params.Get("oauth_timestamp"))
+	if err != nil {
+		return err
+	}
+
+	if v.MinNonceEntropy > 0 {
+		err = v.checkNonce(params.Get("oauth_nonce"), method)
+		if err != nil {
+			return err
+		}
+	}
+
+	consumerKey := params.Get("oauth_consumer_key")
+	if consumerKey == "" {
+		return ErrMissingConsumerKey
+	}
+
+	if v.ConsumerKeys != nil && !v.ConsumerKeys[consumerKey] {
+		return ErrUnknownConsumerKey
+	}
+
+	if v.ValidateConsumerKey != nil {
+		err = v.ValidateConsumerKey(consumerKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	token := params.Get("oauth_token")
+	if token == "" && !v.AllowTwoLegged {
+		return ErrMissingToken
+	}
+
+	if token != "" && v.ValidateToken != nil {
+		err = v.ValidateToken(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	consumerSecrets, err := v.ConsumerSecret(consumerKey)
+	if err != nil {
+		return err
+	}
+
+	// Two-legged requests are signed with an empty token secret.
+	tokenSecrets := []string{""}
+	if token != "" {
+		tokenSecrets, err = v.TokenSecret(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The PLAINTEXT signature is the key itself.
+	var keys []string
+	for _, consumerSecret := range consumerSecrets {
+		for _, tokenSecret := range tokenSecrets {
+			keys = append(keys, encode(consumerSecret)+"&"+encode(tokenSecret))
+		}
+	}
+
+	// The PLAINTEXT signature does not use a base string.
+	if bases == nil {
+		bases = []string{""}
+		if newHash != nil {
+			bases, err = v.baseStrings(req, params)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Accept the signature if it matches any of the consumer and token
+	// secrets. The conformant base string is always tried first.
+	received := []byte(signature)
+	computed := ""
+	for i, base := range bases {
+		for j, key := range keys {
+			expected := key
+			if newHash != nil {
+				expected, err = signHMAC(newHash, base, key)
+				if err != nil {
+					return err
+				}
+			}
+
+			if hmac.Equal(received, []byte(expected)) {
+				return v.checkReplay(consumerKey, params)
+			}
+
+			if i == 0 && j == 0 {
+				computed = expected
+			}
+		}
+	}
+
+	if !v.Debug {
+		return ErrInvalidSignature
+	}
+
+	// Never disclose the secrets that form a PLAINTEXT signature.
+	if method == "PLAINTEXT" {
+		computed = ""
+	}
+
+	return &SignatureMismatchError{
+		Computed:   computed,
+		Received:   signature,
+		BaseString: bases[0],
+	}
+}
+
+// VerifyBaseString is like Verify but compares the signature base string
+// computed for the request with the expected base string, such as one
+// reported by a provider's debug tools, before the signature. A
+// *BaseStringMismatchError is returned if they differ, which separates a
+// disagreement over the base string from a disagreement over the secrets.
+// The request is parsed once for both.
+func (v *Verifier) VerifyBaseString(req *http.Request, expected string) error {
+	return v.verifyRequest(req, &expected)
+}
+
+// baseStrings returns the signature base strings to try for the request, the
+// conformant base string first followed by the one built from the raw query
+// if AllowRawQuery is set.
+func (v *Verifier) baseStrings(req *http.Request, params url.Values) ([]string, error) {
+	r := v.rewrite(req)
+	uri, err := baseStringURI(r, &v.Normalization)
+	if err != nil {
+		return nil, err
+	}
+
+	bases := []string{joinBase(r.Method, uri, params)}
+	if v.AllowRawQuery && r.URL.RawQuery != "" {
+		normalized := normalizeRawQuery(params, r.URL.RawQuery)
+		bases = append(bases, joinNormalizedBase(r.Method, uri, normalized))
+	}
+
+	return bases, nil
+}
+
+// BaseStringMismatchError describes a signature base string that differs
+// from the expected base string. It is returned by VerifyBaseString.
+type BaseStringMismatchError struct {
+	Computed string
+	Expected string
+}
+
+// Offset returns the index of the first byte at which the base strings
+// differ.
+func (e *BaseStringMismatchError) Offset() int {
+	i := 0
+	for i < len(e.Computed) && i < len(e.Expected) && e.Computed[i] == e.Expected[i] {
+		i++
+	}
+
+	return i
+}
+
+func (e *BaseStringMismatchError) Error() string {
+	return "signature base string differs at byte " + strconv.Itoa(e.Offset()) + "\ncomputed " + e.Computed + "\nexpected " + e.Expected
+}
+
+// rewrite returns a copy of the request with the scheme and host reported by
+// a trusted proxy that has been passed to Rewrite, or the request itself if
+// neither applies.
+func (v *Verifier) rewrite(req *http.Request) *http.Request {
+	proto, host := v.forwarded(req)
+	if proto == "" && host == "" && v.Rewrite == nil {
+		return req
+	}
+
+	r := cloneRequest(req)
+	u := *req.URL
+	r.URL = &u
+	if proto != "" {
+		r.URL.Scheme = proto
+	}
+
+	if host != "" {
+		r.Host = host
+	}
+
+	if v.Rewrite != nil {
+		v.Rewrite(r)
+	}
+
+	return r
+}
+
+// VerifyRSA returns nil if the request carries a valid RSA-SHA1 signature for
+// the public key. A form body is buffered and restored so that it may be
+// read again by the handler.
+//
+// See RFC 5849 Section 3.4.3.
+func VerifyRSA(req *http.Request, pub *rsa.PublicKey) error {
+	body, err := readForm(req)
+	if err != nil {
+		return err
+	}
+
+	values, err := parseRequest(req, bytes.NewReader(body), nil)
+	if err != nil {
+		return err
+	}
+
+	params := values.all(nil)
+	signature := params.Get("oauth_signature")
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	params.Del("oauth_signature")
+
+	if params.Get("oauth_signature_method") != "RSA-SHA1" {
+		return ErrUnsupportedSignatureMethod
+	}
+
+	b, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrMalformedSignature
+	}
+
+	uri, err := baseStringURI(req, nil)
+	if err != nil {
+		return err
+	}
+
+	h := sha1.Sum([]byte(joinBase(req.Method, uri, params)))
+	err = rsa.VerifyPKCS1v15(pub, crypto.SHA1, h[:], b)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// DecodeSignature returns the raw bytes of a percent-encoded oauth_signature
+// value as it appears in the Authorization header. ErrMalformedEncoding is
+// returned if the percent encoding is invalid and ErrMalformedSignature if
+// the decoded value is not valid base64.
+//
+// See RFC 5849 Section 3.5.1.
+func DecodeSignature(s string) ([]byte, error) {
+	signature, err := url.PathUnescape(s)
+	if err != nil {
+		return nil, ErrMalformedEncoding
+	}
+
+	b, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrMalformedSignature
+	}
+
+	return b, nil
+}
+
+// checkTimestamp returns nil if the timestamp is omitted or a positive
+// integer, otherwise ErrMalformedTimestamp. A sign is not permitted.
+//
+// See RFC 5849 Section 3.3.
+func checkTimestamp(timestamp string) error {
+	if timestamp == "" {
+		return nil
+	}
+
+	for i := 0; i < len(timestamp); i++ {
+		if timestamp[i] < '0' || timestamp[i] > '9' {
+			return ErrMalformedTimestamp
+		}
+	}
+
+	n, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || n <= 0 {
+		return ErrMalformedTimestamp
+	}
+
+	return nil
+}
+
+// checkNonce returns nil if the estimated entropy of the nonce is at least
+// the MinNonceEntropy.
+func (v *Verifier) checkNonce(nonce, method string) error {
+	if nonce == "" {
+		if method == "PLAINTEXT" {
+			return nil
+		}
+
+		return ErrMissingNonce
+	}
+
+	if nonceEntropy(nonce) < v.MinNonceEntropy {
+		return ErrWeakNonce
+	}
+
+	return nil
+}
+
+// checkReplay records the nonce of a request with a valid signature in the
+// NonceStore, returning ErrNonceReused if it has already been seen.
+func (v *Verifier) checkReplay(consumerKey string, params url.Values) error {
+	nonce := params.Get("oauth_nonce")
+	if v.Nonces == nil || nonce == "" {
+		return nil
+	}
+
+	seen, err := v.Nonces.Seen(consumerKey, nonce, params.Get("oauth_timestamp"))
+	if err != nil {
+		return err
+	}
+
+	if seen {
+		return ErrNonceReused
+	}
+
+	return nil
+}
+
+// nonceEntropy estimates the entropy of the nonce in bits from the
+// frequencies of its characters.
+func nonceEntropy(nonce string) float64 {
+	counts := make(map[byte]int)
+	for i := 0; i < len(nonce); i++ {
+		counts[nonce[i]]++
+	}
+
+	n := float64(len(nonce))
+	bits := 0.0
+	for _, count := range counts {
+		p := float64(count) / n
+		bits -= p * math.Log2(p)
+	}
+
+	return bits * n
+}
+
+// IsSigned returns true if the request carries an oauth_signature in the
+// Authorization header, query or form body. It does not verify the
+// signature, but allows a server that supports several authentication
+// schemes to select the Verifier. A form body is buffered and restored.
+//
+// See RFC 5849 Section 3.5.
+func IsSigned(req *http.Request) bool {
+	body, err := readForm(req)
+	if err != nil {
+		return false
+	}
+
+	values, err := parseRequest(req, bytes.NewReader(body), nil)
+	if err != nil {
+		return false
+	}
+
+	return values.all(nil).Get("oauth_signature") != ""
+}
+
+// StripOAuth removes the OAuth Authorization header and any protocol
+// parameters from the query and form body of the request, such as before it
+// is forwarded to a server behind a verifying proxy. The application
+// parameters are retained as they were sent; only the pairs of protocol
+// parameters are removed from the query and form body.
+func StripOAuth(req *http.Request) error {
+	header := req.Header.Get("Authorization")
+	if len(header) >= 6 && strings.EqualFold(header[:6], "oauth ") {
+		req.Header.Del("Authorization")
+	}
+
+	if query, ok := stripProtocolPairs(req.URL.RawQuery); ok {
+		u := *req.URL
+		u.RawQuery = query
+		req.URL = &u
+		req.RequestURI = ""
+	}
+
+	if req.Form != nil {
+		removeProtocolParameters(req.Form)
+	}
+
+	if req.PostForm != nil {
+		removeProtocolParameters(req.PostForm)
+	}
+
+	if !hasBody(strings.ToUpper(req.Method)) || !isForm(req.Header) {
+		return nil
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	form, ok := stripProtocolPairs(string(body))
+	if !ok {
+		return nil
+	}
+
+	body = []byte(form)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+
+	return nil
+}
+
+// stripProtocolPairs returns the application/x-www-form-urlencoded data
+// without the pairs of protocol parameters, and whether any were removed.
+// The other pairs are left as they were rather than being re-encoded, so
+// that pairs that do not decode are retained.
+func stripProtocolPairs(s string) (string, bool) {
+	pairs := strings.Split(s, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		name := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+		}
+
+		if k, err := url.QueryUnescape(name); err == nil && strings.HasPrefix(k, "oauth_") {
+			continue
+		}
+
+		kept = append(kept, pair)
+	}
+
+	if len(kept) == len(pairs) {
+		return s, false
+	}
+
+	return strings.Join(kept, "&"), true
+}
+
+// removeProtocolParameters deletes the protocol parameters from values.
+func removeProtocolParameters(values url.Values) {
+	for k := range values {
+		if strings.HasPrefix(k, "oauth_") {
+			delete(values, k)
+		}
+	}
+}
+
+// hasProtocolParameters returns true if any of the values is a protocol
+// parameter.
+func hasProtocolParameters(values url.Values) bool {
+	for k := range values {
+		if strings.HasPrefix(k, "oauth_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSecure returns true if the request was received over TLS, either
+// directly or by a trusted proxy that set the X-Forwarded-Proto header to
+// https.
+func (v *Verifier) isSecure(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+
+	proto, _ := v.forwarded(req)
+
+	return proto == "https"
+}
+
+// forwarded returns the scheme and host of the request reported by the
+// X-Forwarded-Proto and X-Forwarded-Host headers if it is from one of the
+// TrustedProxies. The first of several comma-separated values is the one
+// received by the outermost proxy. The scheme is lowercase and empty unless
+// it is http or https.
+func (v *Verifier) forwarded(req *http.Request) (string, string) {
+	if !v.trustedProxy(req.RemoteAddr) {
+		return "", ""
+	}
+
+	proto := strings.ToLower(firstForwarded(req.Header.Get("X-Forwarded-Proto")))
+	if proto != "http" && proto != "https" {
+		proto = ""
+	}
+
+	return proto, firstForwarded(req.Header.Get("X-Forwarded-Host"))
+}
+
+// firstForwarded returns the first value of a comma-separated forwarded
+// header.
+func firstForwarded(s string) string {
+	if i := strings.Index(s, ","); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+// trustedProxy returns true if the IP address of remoteAddr, which may
+// include a port, is one of the TrustedProxies.
+func (v *Verifier) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range v.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			_, network, err := net.ParseCIDR(proxy)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,1932 @@
+package oauth1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testTransport = &Transport{
+	Key:    "dpf43f3p2l4k3l03",
+	Secret: "kd94hf93k423kf44",
+	Token: &Token{
+		Key:    "nnch734d00sl2jdk",
+		Secret: "pfkkdhi9sl3r4s00",
+	},
+}
+
+var testVerifier = &Verifier{
+	ConsumerSecret: func(key string) ([]string, error) {
+		return []string{"kd94hf93k423kf44"}, nil
+	},
+	TokenSecret: func(token string) ([]string, error) {
+		return []string{"pfkkdhi9sl3r4s00"}, nil
+	},
+}
+
+func TestVerify(t *testing.T) {
+	uri := "http://photos.example.net/photos?size=original"
+	body := strings.NewReader("file=vacation.jpg")
+	req, err := testTransport.NewRequest(context.Background(), "POST", uri, body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if string(b) != "file=vacation.jpg" {
+		t.Errorf("body\nhave %s\nwant %s", b, "file=vacation.jpg")
+	}
+
+	req.Header.Set("Content-Type", "text/plain")
+	err = testVerifier.VerifyBody(req, b)
+	if err != ErrInvalidSignature {
+		t.Errorf("tampered request\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	uri := "http://photos.example.net/photos?size=original"
+	body := strings.NewReader("file=vacation.jpg")
+	req, err := testTransport.NewRequest(context.Background(), "POST", uri, body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Consume the body as an earlier handler would.
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = testVerifier.VerifyBody(req, b)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+type seekBody struct {
+	*strings.Reader
+}
+
+func (b seekBody) Close() error {
+	return nil
+}
+
+func TestVerifySeeker(t *testing.T) {
+	uri := "http://photos.example.net/photos?size=original"
+	req, err := testTransport.NewRequest(context.Background(), "POST", uri, strings.NewReader("file=vacation.jpg"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	body := seekBody{strings.NewReader("file=vacation.jpg")}
+	req.Body = body
+
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if req.Body != body {
+		t.Errorf("seekable body should not be replaced")
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if string(b) != "file=vacation.jpg" {
+		t.Errorf("body\nhave %s\nwant %s", b, "file=vacation.jpg")
+	}
+}
+
+func TestVerifySeekerOffset(t *testing.T) {
+	uri := "http://photos.example.net/photos?size=original"
+	req, err := testTransport.NewRequest(context.Background(), "POST", uri, strings.NewReader("file=vacation.jpg"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The form follows data already consumed by an earlier handler.
+	preamble := "--preamble--"
+	body := seekBody{strings.NewReader(preamble + "file=vacation.jpg")}
+	_, err = body.Seek(int64(len(preamble)), io.SeekStart)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Body = body
+	err = testVerifier.Verify(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if req.Body != body {
+		t.Errorf("seekable body should not be replaced")
+	}
+
+	offset, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if offset != int64(len(preamble)) {
+		t.Errorf("offset\nhave %d\nwant %d", offset, len(preamble))
+	}
+}
+
+func TestVerifyTwoLegged(t *testing.T) {
+	var tests = []struct {
+		// in
+		token          *Token
+		allowTwoLegged bool
+
+		// out
+		err error
+	}{
+		{testTransport.Token, false, nil},
+		{testTransport.Token, true, nil},
+		{nil, false, ErrMissingToken},
+		{nil, true, nil},
+		{&Token{}, false, ErrMissingToken},
+		{&Token{}, true, nil},
+	}
+
+	for i, tt := range tests {
+		tr := *testTransport
+		tr.Token = tt.token
+		req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// An empty token is sent as an empty oauth_token.
+		header := req.Header.Get("Authorization")
+		if tt.token != nil && tt.token.Key == "" && !strings.Contains(header, `oauth_token=""`) {
+			t.Errorf("%d. oauth_token should be empty\nhave %s", i, header)
+		}
+
+		v := *testVerifier
+		v.AllowTwoLegged = tt.allowTwoLegged
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyPlaintext(t *testing.T) {
+	var tests = []struct {
+		// in
+		tls                 *tls.ConnectionState
+		forwardedProto      string
+		requirePlaintextTLS bool
+
+		// out
+		err error
+	}{
+		{nil, "", false, nil},
+		{nil, "", true, ErrInsecurePlaintext},
+		{nil, "https", true, ErrInsecurePlaintext},
+		{&tls.ConnectionState{}, "", true, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "https://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.TLS = tt.tls
+		req.RemoteAddr = "10.0.0.1:1234"
+		if tt.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+		}
+
+		req.Header.Set("Authorization", `OAuth oauth_consumer_key="dpf43f3p2l4k3l03", `+
+			`oauth_token="nnch734d00sl2jdk", oauth_signature_method="PLAINTEXT", `+
+			`oauth_signature="kd94hf93k423kf44%26pfkkdhi9sl3r4s00"`)
+
+		v := *testVerifier
+		v.RequirePlaintextTLS = tt.requirePlaintextTLS
+		v.TrustedProxies = []string{"10.0.0.1"}
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyServerName(t *testing.T) {
+	var tests = []struct {
+		// in
+		serverName bool
+
+		// out
+		err error
+	}{
+		{false, ErrInvalidSignature},
+		{true, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "https://tenant.example.com/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// The gateway forwards the request to an internal host.
+		req.Host = "gateway.internal"
+		req.URL.Host = "gateway.internal"
+		req.TLS = &tls.ConnectionState{ServerName: "tenant.example.com"}
+
+		v := *testVerifier
+		v.Normalization.ServerName = tt.serverName
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMixedCaseHeader(t *testing.T) {
+	var tests = []struct {
+		// in
+		lowercase bool
+
+		// out
+		err error
+	}{
+		{false, ErrMissingSignature},
+		{true, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		header := req.Header.Get("Authorization")
+		header = strings.Replace(header, "oauth_consumer_key=", "OAuth_Consumer_Key=", 1)
+		header = strings.Replace(header, "oauth_signature=", "OAuth_Signature=", 1)
+		req.Header.Set("Authorization", header)
+
+		v := *testVerifier
+		v.Normalization.LowercaseHeaderNames = tt.lowercase
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyConsumerKeys(t *testing.T) {
+	var tests = []struct {
+		// in
+		consumerKeys map[string]bool
+
+		// out
+		err error
+	}{
+		{nil, nil},
+		{map[string]bool{"dpf43f3p2l4k3l03": true}, nil},
+		{map[string]bool{"9djdj82h48djs9d2": true}, ErrUnknownConsumerKey},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		called := false
+		v := *testVerifier
+		v.ConsumerKeys = tt.consumerKeys
+		v.ConsumerSecret = func(key string) ([]string, error) {
+			called = true
+			return testVerifier.ConsumerSecret(key)
+		}
+
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if tt.err != nil && called {
+			t.Errorf("%d. unknown consumer key should be rejected before lookup", i)
+		}
+	}
+}
+
+func TestVerifyValidateToken(t *testing.T) {
+	errTokenLength := errors.New("token must be 16 characters")
+
+	var tests = []struct {
+		// in
+		token string
+
+		// out
+		err error
+	}{
+		{"nnch734d00sl2jdk", nil},
+		{"nnch734d00sl2jd", errTokenLength},
+		{"nnch734d00sl2jdkx", errTokenLength},
+	}
+
+	for i, tt := range tests {
+		tr := *testTransport
+		tr.Token = &Token{Key: tt.token, Secret: testTransport.Token.Secret}
+		req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		called := false
+		v := *testVerifier
+		v.ValidateToken = func(token string) error {
+			if len(token) != 16 {
+				return errTokenLength
+			}
+
+			return nil
+		}
+		v.TokenSecret = func(token string) ([]string, error) {
+			called = true
+			return testVerifier.TokenSecret(token)
+		}
+
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if tt.err != nil && called {
+			t.Errorf("%d. malformed token should be rejected before lookup", i)
+		}
+	}
+}
+
+func TestVerifyDebug(t *testing.T) {
+	req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.URL.RawQuery = "size=original"
+
+	err = testVerifier.Verify(req)
+	if err != ErrInvalidSignature {
+		t.Errorf("production mode\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+
+	v := *testVerifier
+	v.Debug = true
+	err = v.Verify(req)
+	e, ok := err.(*SignatureMismatchError)
+	if !ok {
+		t.Fatalf("debug mode\nhave %v\nwant *SignatureMismatchError", err)
+	}
+
+	params, err := parseAuthorizationHeader(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if e.Received != params.Get("oauth_signature") {
+		t.Errorf("Received\nhave %s\nwant %s", e.Received, params.Get("oauth_signature"))
+	}
+
+	if e.Computed == "" || e.Computed == e.Received {
+		t.Errorf("Computed should be the expected signature\nhave %s", e.Computed)
+	}
+
+	if !strings.Contains(e.BaseString, "size%3Doriginal") {
+		t.Errorf("BaseString should include the tampered query\nhave %s", e.BaseString)
+	}
+}
+
+func TestVerifyChunked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("request should be chunked\nhave %v", r.TransferEncoding)
+		}
+
+		err := testVerifier.Verify(r)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+
+		if r.PostForm.Get("title") != "Sunset" {
+			t.Errorf("body should be restored\nhave %v", r.PostForm)
+		}
+	}))
+	defer ts.Close()
+
+	// A body of unknown length is sent with chunked transfer encoding.
+	body := struct{ io.Reader }{strings.NewReader("title=Sunset&size=original")}
+	req, err := http.NewRequest("POST", ts.URL+"/photos", body)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := testTransport.Client().Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	response.Body.Close()
+}
+
+// unreadBody is a request body that fails the test if it is read.
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Errorf("body should not be read")
+	return 0, io.EOF
+}
+
+func (b unreadBody) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (b unreadBody) Close() error {
+	return nil
+}
+
+func TestVerifyUnreadBody(t *testing.T) {
+	req, err := http.NewRequest("PUT", "http://photos.example.net/photos/vacation.jpg", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The body is not a form, so it is not part of the signature.
+	req.Header.Set("Content-Type", "application/octet-stream")
+	err = testTransport.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Neither a seekable body nor one that would otherwise be buffered is
+	// read.
+	for _, body := range []io.ReadCloser{unreadBody{t}, struct{ io.ReadCloser }{unreadBody{t}}} {
+		req.Body = body
+		err = testVerifier.Verify(req)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		if req.Body != body {
+			t.Errorf("body should not be replaced")
+		}
+	}
+}
+
+func TestVerifyFormTooLarge(t *testing.T) {
+	body := "title=" + strings.Repeat("a", 10<<20)
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	params := testParameters()
+	params.Set("oauth_signature", "tR3+Ty81lMeYAr/Fid0kMTYa/WM=")
+	req.Header.Set("Authorization", makeAuthorizationHeader(params, false))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	err = testVerifier.Verify(req)
+	if err != errFormTooLarge {
+		t.Errorf("Verify\nhave %v\nwant %v", err, errFormTooLarge)
+	}
+}
+
+func TestVerifyParameterLocations(t *testing.T) {
+	var tests = []struct {
+		// in
+		header string
+		query  string
+		body   string
+
+		// out
+		err error
+	}{
+		{
+			`OAuth oauth_consumer_key="dpf43f3p2l4k3l03", oauth_token="nnch734d00sl2jdk", oauth_signature_method="HMAC-SHA1"`,
+			"size=original&oauth_nonce=kllo9940pd9333jh",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+			nil,
+		},
+		{
+			`OAuth oauth_consumer_key="dpf43f3p2l4k3l03", oauth_token="nnch734d00sl2jdk", oauth_signature_method="HMAC-SHA1", oauth_nonce="kllo9940pd9333jh"`,
+			"size=original&oauth_nonce=kllo9940pd9333jh",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+			ErrDuplicateParameter,
+		},
+	}
+
+	for i, tt := range tests {
+		newRequest := func(header string) *http.Request {
+			req, err := http.NewRequest("POST", "http://photos.example.net/photos?"+tt.query, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", header)
+			return req
+		}
+
+		base, err := signatureBase(newRequest(tt.header), nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		signature, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req := newRequest(tt.header + `, oauth_signature="` + encode(signature) + `"`)
+		err = testVerifier.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifySingleLocation(t *testing.T) {
+	var tests = []struct {
+		// in
+		first  string
+		second string
+
+		// out
+		err error
+	}{
+		{"header", "header", nil},
+		{"query", "query", nil},
+		{"body", "body", nil},
+		{"header", "query", ErrMixedParameterLocations},
+		{"query", "body", ErrMixedParameterLocations},
+		{"body", "header", ErrMixedParameterLocations},
+	}
+
+	for i, tt := range tests {
+		newRequest := func(header, query, body url.Values) *http.Request {
+			query.Set("size", "original")
+			body.Set("file", "vacation.jpg")
+			req, err := http.NewRequest("POST", "http://photos.example.net/photos?"+query.Encode(), strings.NewReader(body.Encode()))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if len(header) > 0 {
+				req.Header.Set("Authorization", makeAuthorizationHeader(header, false))
+			}
+
+			return req
+		}
+
+		params := testParameters()
+		base, err := signatureBase(newRequest(url.Values{}, url.Values{}, url.Values{}), params, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		signature, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params.Set("oauth_signature", signature)
+
+		// The first three protocol parameters are sent in the first location
+		// and the remainder in the second.
+		locations := map[string]url.Values{"header": {}, "query": {}, "body": {}}
+		for _, p := range sortParameters(params) {
+			location := tt.second
+			if len(locations[tt.first]) < 3 {
+				location = tt.first
+			}
+
+			locations[location].Add(p.Key, p.Value)
+		}
+
+		req := newRequest(locations["header"], locations["query"], locations["body"])
+		v := *testVerifier
+		err = v.Verify(req)
+		if err != nil {
+			t.Errorf("%d. unexpected error %v", i, err)
+		}
+
+		req = newRequest(locations["header"], locations["query"], locations["body"])
+		v.SingleLocation = true
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMaxParameters(t *testing.T) {
+	var tests = []struct {
+		// in
+		n int
+
+		// out
+		err error
+	}{
+		{10, nil},
+		{1000, ErrTooManyParameters},
+	}
+
+	for i, tt := range tests {
+		query := make([]string, tt.n)
+		for j := range query {
+			query[j] = "p" + strconv.Itoa(j) + "=1"
+		}
+
+		uri := "http://photos.example.net/photos?" + strings.Join(query, "&")
+		req, err := testTransport.NewRequest(context.Background(), "GET", uri, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.MaxParameters = 100
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyRewrite(t *testing.T) {
+	req, err := testTransport.NewRequest(context.Background(), "GET", "http://api.example.net/v1/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The load balancer strips the version prefix.
+	req.URL.Path = "/photos"
+
+	err = testVerifier.Verify(req)
+	if err != ErrInvalidSignature {
+		t.Errorf("without rewrite\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+
+	v := *testVerifier
+	v.Rewrite = func(req *http.Request) {
+		req.URL.Path = "/v1" + req.URL.Path
+	}
+
+	err = v.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if req.URL.Path != "/photos" {
+		t.Errorf("request should not be modified\nhave %s\nwant %s", req.URL.Path, "/photos")
+	}
+}
+
+func TestVerifyVersion(t *testing.T) {
+	var tests = []struct {
+		// in
+		version []string
+
+		// out
+		err error
+	}{
+		{[]string{"1.0"}, nil},
+		{[]string{"2.0"}, ErrUnsupportedVersion},
+		{nil, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := testParameters()
+		params.Del("oauth_version")
+		if tt.version != nil {
+			params["oauth_version"] = tt.version
+		}
+
+		signHeader(t, req, params)
+
+		err = testVerifier.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyConsumerSecretRotation(t *testing.T) {
+	var tests = []struct {
+		// in
+		secrets []string
+
+		// out
+		err error
+	}{
+		{[]string{"kd94hf93k423kf44"}, nil},
+		{[]string{"fd86d5ee0e5b2f1b", "kd94hf93k423kf44"}, nil},
+		{[]string{"fd86d5ee0e5b2f1b"}, ErrInvalidSignature},
+		{nil, ErrInvalidSignature},
+	}
+
+	for i, tt := range tests {
+		// The request is signed with the old secret.
+		req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.ConsumerSecret = func(key string) ([]string, error) {
+			return tt.secrets, nil
+		}
+
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyTokenSecretRotation(t *testing.T) {
+	var tests = []struct {
+		// in
+		secrets []string
+
+		// out
+		err error
+	}{
+		{[]string{"pfkkdhi9sl3r4s00"}, nil},
+		{[]string{"a3f8e1c27b9d4e05", "pfkkdhi9sl3r4s00"}, nil},
+		{[]string{"a3f8e1c27b9d4e05"}, ErrInvalidSignature},
+		{nil, ErrInvalidSignature},
+	}
+
+	for i, tt := range tests {
+		// The request is signed with the old secret.
+		req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.TokenSecret = func(token string) ([]string, error) {
+			return tt.secrets, nil
+		}
+
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyAll(t *testing.T) {
+	var reqs []*http.Request
+	for _, query := range []string{"size=original", "size=small", "size=large"} {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "http://photos.example.net/photos?"+query, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	// Tamper with the second request.
+	reqs[1].URL.RawQuery = "size=tiny"
+
+	lookups := 0
+	v := *testVerifier
+	v.ConsumerSecret = func(key string) ([]string, error) {
+		lookups++
+		return testVerifier.ConsumerSecret(key)
+	}
+
+	errs := v.VerifyAll(reqs)
+	expected := []error{nil, ErrInvalidSignature, nil}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("incorrect\nhave %v\nwant %v", errs, expected)
+	}
+
+	if lookups != 1 {
+		t.Errorf("consumer secret lookups\nhave %d\nwant %d", lookups, 1)
+	}
+}
+
+func TestVerifyRawQuery(t *testing.T) {
+	var tests = []struct {
+		// in
+		allowRawQuery bool
+		conformant    bool
+
+		// out
+		err error
+	}{
+		{false, true, nil},
+		{true, true, nil},
+		{false, false, ErrInvalidSignature},
+		{true, false, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?title=hi+there!", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := testParameters()
+		if tt.conformant {
+			signHeader(t, req, params)
+		} else {
+			// The buggy client signs the raw query.
+			normalized := normalizeParameters(params) + "&title=hi+there!"
+			base := "GET&" + encode("http://photos.example.net/photos") + "&" + encode(normalized)
+			signature, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			params.Set("oauth_signature", signature)
+			req.Header.Set("Authorization", makeAuthorizationHeader(params, false))
+		}
+
+		v := *testVerifier
+		v.AllowRawQuery = tt.allowRawQuery
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMissingSignature(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Authorization", makeAuthorizationHeader(testParameters(), false))
+
+	err = testVerifier.Verify(req)
+	if err != ErrMissingSignature {
+		t.Errorf("Verify\nhave %v\nwant %v", err, ErrMissingSignature)
+	}
+
+	err = VerifyRSA(req, nil)
+	if err != ErrMissingSignature {
+		t.Errorf("VerifyRSA\nhave %v\nwant %v", err, ErrMissingSignature)
+	}
+}
+
+func TestVerifyExclude(t *testing.T) {
+	tr := *testTransport
+	tr.Normalization.Exclude = []string{"_"}
+
+	req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos?size=original&_=1191242096", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if v := req.URL.Query().Get("_"); v != "1191242096" {
+		t.Errorf("excluded parameter should be sent\nhave %s\nwant %s", v, "1191242096")
+	}
+
+	base, err := signatureBase(req, nil, &tr.Normalization)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if strings.Contains(base, "_%3D1191242096") {
+		t.Errorf("excluded parameter should not be signed\nhave %s", base)
+	}
+
+	// The cache-buster changes after signing.
+	req.URL.RawQuery = "size=original&_=1191242097"
+
+	v := *testVerifier
+	v.Normalization.Exclude = []string{"_"}
+	err = v.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestVerifyMalformedTimestamp(t *testing.T) {
+	var tests = []struct {
+		// in
+		timestamp string
+		method    string
+
+		// out
+		err error
+	}{
+		{"1191242096", "HMAC-SHA1", nil},
+		{"1", "HMAC-SHA1", nil},
+		{"", "PLAINTEXT", nil},
+		{"1191242096.5", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"12.5", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"abc", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"-1", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"-1191242096", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"+1191242096", "HMAC-SHA1", ErrMalformedTimestamp},
+		{"0", "PLAINTEXT", ErrMalformedTimestamp},
+		{"99999999999999999999", "HMAC-SHA1", ErrMalformedTimestamp},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := url.Values{}
+		if tt.timestamp != "" {
+			params.Set("oauth_timestamp", tt.timestamp)
+		}
+
+		tr := *testTransport
+		tr.SignatureMethod = tt.method
+		err = tr.Sign(req, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// The Transport always sends a timestamp.
+		if tt.timestamp == "" {
+			values, err := parseAuthorizationHeader(req, nil)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			values.Del("oauth_timestamp")
+			req.Header.Set("Authorization", makeAuthorizationHeader(values, false))
+		}
+
+		err = testVerifier.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMinNonceEntropy(t *testing.T) {
+	var tests = []struct {
+		// in
+		entropy float64
+		nonce   string
+		method  string
+
+		// out
+		err error
+	}{
+		{0, "0", "HMAC-SHA1", nil},
+		{64, "00000000000000000000000000000000", "HMAC-SHA1", ErrWeakNonce},
+		{64, "abc", "HMAC-SHA1", ErrWeakNonce},
+		{64, "kllo9940pd9333jh", "HMAC-SHA1", ErrWeakNonce},
+		{64, "kllo9940pd9333jhM8e1HEabefjfMm", "HMAC-SHA1", nil},
+		{64, "", "HMAC-SHA1", ErrMissingNonce},
+		{64, "", "PLAINTEXT", nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// An empty oauth_nonce is omitted by the Transport.
+		params := url.Values{"oauth_nonce": {tt.nonce}}
+
+		tr := *testTransport
+		tr.SignatureMethod = tt.method
+		err = tr.Sign(req, params)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.MinNonceEntropy = tt.entropy
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMinNonceEntropyGenerated(t *testing.T) {
+	for _, numeric := range []bool{false, true} {
+		tr := *testTransport
+		tr.NumericNonce = numeric
+		req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.MinNonceEntropy = 64
+		err = v.Verify(req)
+		if err != nil {
+			t.Errorf("numeric %v: unexpected error %v", numeric, err)
+		}
+	}
+}
+
+func TestVerifyRequireTLS(t *testing.T) {
+	var tests = []struct {
+		// in
+		requireTLS     bool
+		tls            *tls.ConnectionState
+		forwardedProto string
+
+		// out
+		err error
+	}{
+		{false, nil, "", nil},
+		{true, nil, "", ErrInsecureTransport},
+		{true, nil, "http", ErrInsecureTransport},
+		{true, nil, "https", ErrInsecureTransport},
+		{true, &tls.ConnectionState{}, "", nil},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "https://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.TLS = tt.tls
+		if tt.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+		}
+
+		v := *testVerifier
+		v.RequireTLS = tt.requireTLS
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		// in
+		proxies        []string
+		remoteAddr     string
+		tls            *tls.ConnectionState
+		forwardedProto string
+
+		// out
+		err error
+	}{
+		{nil, "203.0.113.7:1234", nil, "https", ErrInsecureTransport},
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", nil, "https", nil},
+		{[]string{"10.0.0.1"}, "10.0.0.2:1234", nil, "https", ErrInsecureTransport},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", nil, "https", nil},
+		{[]string{"10.0.0.0/8"}, "203.0.113.7:1234", nil, "https", ErrInsecureTransport},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", nil, "http", ErrInsecureTransport},
+		{[]string{"2001:db8::/32"}, "[2001:db8::1]:1234", nil, "https", nil},
+		{[]string{"::1"}, "[::1]:1234", nil, "https", nil},
+		{[]string{"10.0.0.0/8"}, "", nil, "https", ErrInsecureTransport},
+		{[]string{"malformed", "10.0.0.0/33"}, "10.1.2.3:1234", nil, "https", ErrInsecureTransport},
+		{[]string{"10.0.0.1"}, "203.0.113.7:1234", &tls.ConnectionState{}, "", nil},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "https://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.RemoteAddr = tt.remoteAddr
+		req.TLS = tt.tls
+		if tt.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+		}
+
+		v := *testVerifier
+		v.RequireTLS = true
+		v.TrustedProxies = tt.proxies
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyForwardedHost(t *testing.T) {
+	var tests = []struct {
+		// in
+		proxies        []string
+		remoteAddr     string
+		forwardedProto string
+		forwardedHost  string
+
+		// out
+		err error
+	}{
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", "https", "photos.example.net", nil},
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", "HTTPS", "photos.example.net, backend.internal", nil},
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", "", "photos.example.net", ErrInvalidSignature},
+		{[]string{"10.0.0.1"}, "10.0.0.1:1234", "https", "", ErrInvalidSignature},
+		{[]string{"10.0.0.1"}, "203.0.113.7:1234", "https", "photos.example.net", ErrInvalidSignature},
+		{nil, "10.0.0.1:1234", "https", "photos.example.net", ErrInvalidSignature},
+	}
+
+	for i, tt := range tests {
+		req, err := testTransport.NewRequest(context.Background(), "GET", "https://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// The proxy forwards the request to an internal host over HTTP.
+		req.URL = &url.URL{Path: "/photos"}
+		req.Host = "backend.internal"
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+		}
+
+		if tt.forwardedHost != "" {
+			req.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+		}
+
+		v := *testVerifier
+		v.TrustedProxies = tt.proxies
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+
+		if req.Host != "backend.internal" || req.URL.Scheme != "" {
+			t.Errorf("%d. request was modified", i)
+		}
+	}
+}
+
+func TestIsSigned(t *testing.T) {
+	var tests = []struct {
+		// in
+		header string
+		query  string
+		body   string
+
+		// out
+		out bool
+	}{
+		{`OAuth oauth_consumer_key="dpf43f3p2l4k3l03", oauth_signature="tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D"`, "", "", true},
+		{"", "oauth_consumer_key=dpf43f3p2l4k3l03&oauth_signature=tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D", "", true},
+		{"", "", "oauth_consumer_key=dpf43f3p2l4k3l03&oauth_signature=tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D", true},
+		{`OAuth oauth_consumer_key="dpf43f3p2l4k3l03"`, "", "", false},
+		{"", "oauth_consumer_key=dpf43f3p2l4k3l03", "", false},
+		{"", "", "file=vacation.jpg", false},
+		{"Bearer mF_9.B5f-4.1JqM", "", "", false},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://photos.example.net/photos?"+tt.query, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		out := IsSigned(req)
+		if out != tt.out {
+			t.Errorf("%d. IsSigned\nhave %v\nwant %v", i, out, tt.out)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if string(body) != tt.body {
+			t.Errorf("%d. body should be restored\nhave %s\nwant %s", i, body, tt.body)
+		}
+	}
+}
+
+func TestVerifyBaseString(t *testing.T) {
+	var tests = []struct {
+		// in
+		expected string
+
+		// out
+		offset int
+	}{
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_consumer_key%3Ddpf43f3p2l4k3l03%26oauth_nonce%3Dkllo9940pd9333jh%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1191242096%26oauth_token%3Dnnch734d00sl2jdk%26oauth_version%3D1.0%26size%3Doriginal", -1},
+		{"GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg%26oauth_consumer_key%3Ddpf43f3p2l4k3l03%26oauth_nonce%3Dkllo9940pd9333jh%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1191242096%26oauth_token%3Dnnch734d00sl2jdk%26oauth_version%3D1.0", 260},
+		{"GET&https%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacation.jpg", 8},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?file=vacation.jpg&size=original", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		signHeader(t, req, testParameters())
+
+		err = testVerifier.VerifyBaseString(req, tt.expected)
+		if tt.offset < 0 {
+			if err != nil {
+				t.Errorf("%d. unexpected error %v", i, err)
+			}
+
+			continue
+		}
+
+		mismatch, ok := err.(*BaseStringMismatchError)
+		if !ok {
+			t.Errorf("%d. VerifyBaseString\nhave %v\nwant *BaseStringMismatchError", i, err)
+			continue
+		}
+
+		if mismatch.Offset() != tt.offset {
+			t.Errorf("%d. Offset\nhave %d\nwant %d", i, mismatch.Offset(), tt.offset)
+		}
+	}
+}
+
+func TestVerifyBaseStringSeeker(t *testing.T) {
+	uri := "http://photos.example.net/photos?size=original"
+	req, err := testTransport.NewRequest(context.Background(), "POST", uri, strings.NewReader("file=vacation.jpg"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	body := seekBody{strings.NewReader("file=vacation.jpg")}
+	req.Body = body
+
+	err = testVerifier.VerifyBaseString(req, "")
+	if _, ok := err.(*BaseStringMismatchError); !ok {
+		t.Fatalf("VerifyBaseString\nhave %v\nwant *BaseStringMismatchError", err)
+	}
+
+	if req.Body != body {
+		t.Errorf("seekable body should not be replaced")
+	}
+
+	if body.Len() != len("file=vacation.jpg") {
+		t.Errorf("body should be rewound\nhave %d bytes unread\nwant %d", body.Len(), len("file=vacation.jpg"))
+	}
+}
+
+func TestVerifyAssumeHMACSHA1(t *testing.T) {
+	var tests = []struct {
+		// in
+		assume bool
+
+		// out
+		err error
+	}{
+		{false, ErrUnsupportedSignatureMethod},
+		{true, nil},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := testParameters()
+		params.Del("oauth_signature_method")
+		signHeader(t, req, params)
+
+		v := *testVerifier
+		v.AssumeHMACSHA1 = tt.assume
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyHMACHashes(t *testing.T) {
+	var tests = []struct {
+		// in
+		hashes map[string]func() hash.Hash
+
+		// out
+		err error
+	}{
+		{nil, ErrUnsupportedSignatureMethod},
+		{map[string]func() hash.Hash{"HMAC-SHA512": sha512.New}, nil},
+		{map[string]func() hash.Hash{"HMAC-SHA512": sha256.New}, ErrInvalidSignature},
+	}
+
+	for i, tt := range tests {
+		tr := *testTransport
+		tr.SignatureMethod = "HMAC-SHA512"
+		tr.Signer = func(base string) (string, error) {
+			return signHMAC(sha512.New, base, tr.key())
+		}
+
+		req, err := tr.NewRequest(context.Background(), "GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		v := *testVerifier
+		v.HMACHashes = tt.hashes
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestStripOAuth(t *testing.T) {
+	var tests = []struct {
+		// in
+		header      string
+		query       string
+		body        string
+		contentType string
+
+		// out
+		outHeader string
+		outQuery  string
+		outBody   string
+	}{
+		{
+			`OAuth oauth_consumer_key="dpf43f3p2l4k3l03", oauth_signature="tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D"`,
+			"size=original&oauth_nonce=kllo9940pd9333jh",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+			"application/x-www-form-urlencoded",
+			"",
+			"size=original",
+			"file=vacation.jpg",
+		},
+		{
+			"Bearer mF_9.B5f-4.1JqM",
+			"size=original&b=2&a=1",
+			"file=vacation.jpg",
+			"application/x-www-form-urlencoded",
+			"Bearer mF_9.B5f-4.1JqM",
+			"size=original&b=2&a=1",
+			"file=vacation.jpg",
+		},
+		{
+			"",
+			"oauth_token=nnch734d00sl2jdk",
+			"oauth_signature=tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D&xoauth_requestor_id=1234",
+			"application/x-www-form-urlencoded",
+			"",
+			"",
+			"xoauth_requestor_id=1234",
+		},
+		{
+			"",
+			"",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+			"application/x-www-form-urlencoded; charset=utf-8",
+			"",
+			"",
+			"file=vacation.jpg",
+		},
+		{
+			"",
+			"",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+			"text/plain",
+			"",
+			"",
+			"file=vacation.jpg&oauth_timestamp=1191242096",
+		},
+		{
+			"",
+			"a=1;b=2&oauth_nonce=kllo9940pd9333jh&c=%7e&d",
+			"x=%2a&oauth%5Ftimestamp=1191242096&y=a+b",
+			"application/x-www-form-urlencoded",
+			"",
+			"a=1;b=2&c=%7e&d",
+			"x=%2a&y=a+b",
+		},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", "http://photos.example.net/photos?"+tt.query, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		err = StripOAuth(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if header := req.Header.Get("Authorization"); header != tt.outHeader {
+			t.Errorf("%d. Authorization\nhave %s\nwant %s", i, header, tt.outHeader)
+		}
+
+		if req.URL.RawQuery != tt.outQuery {
+			t.Errorf("%d. query\nhave %s\nwant %s", i, req.URL.RawQuery, tt.outQuery)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if string(body) != tt.outBody {
+			t.Errorf("%d. body\nhave %s\nwant %s", i, body, tt.outBody)
+		}
+
+		if req.ContentLength != int64(len(tt.outBody)) {
+			t.Errorf("%d. ContentLength\nhave %d\nwant %d", i, req.ContentLength, len(tt.outBody))
+		}
+	}
+}
+
+func TestVerifyRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tests = []struct {
+		// in
+		tamper func(req *http.Request)
+
+		// out
+		err error
+	}{
+		{func(req *http.Request) {}, nil},
+		{func(req *http.Request) { req.URL.RawQuery = "size=small" }, ErrInvalidSignature},
+		{func(req *http.Request) {
+			header := strings.Replace(req.Header.Get("Authorization"), `oauth_signature="`, `oauth_signature="%21`, 1)
+			req.Header.Set("Authorization", header)
+		}, ErrMalformedSignature},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tr := Transport{
+			Key:             "dpf43f3p2l4k3l03",
+			SignatureMethod: "RSA-SHA1",
+			PrivateKey:      key,
+		}
+
+		err = tr.Sign(req, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		tt.tamper(req)
+
+		err = VerifyRSA(req, &key.PublicKey)
+		if err != tt.err {
+			t.Errorf("%d. VerifyRSA\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	var tests = []struct {
+		// in
+		in string
+
+		// out
+		out string
+		err error
+	}{
+		{"tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D", "tR3+Ty81lMeYAr/Fid0kMTYa/WM=", nil},
+		{"tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3", "", ErrMalformedEncoding},
+		{"tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%21", "", ErrMalformedSignature},
+	}
+
+	for i, tt := range tests {
+		b, err := DecodeSignature(tt.in)
+		if err != tt.err {
+			t.Errorf("%d. DecodeSignature %s\nhave %v\nwant %v", i, tt.in, err, tt.err)
+			continue
+		}
+
+		if out := base64.StdEncoding.EncodeToString(b); err == nil && out != tt.out {
+			t.Errorf("%d. DecodeSignature %s\nhave %s\nwant %s", i, tt.in, out, tt.out)
+		}
+	}
+}
+
+// testParameters returns the protocol parameters of a request signed by
+// testTransport without the oauth_signature.
+func testParameters() url.Values {
+	return url.Values{
+		"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+		"oauth_token":            {"nnch734d00sl2jdk"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"1191242096"},
+		"oauth_nonce":            {"kllo9940pd9333jh"},
+		"oauth_version":          {"1.0"},
+	}
+}
+
+// signHeader sets an Authorization header containing params, signed with the
+// secrets known to testVerifier.
+func signHeader(t *testing.T, req *http.Request, params url.Values) {
+	base, err := signatureBase(req, params, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	signature, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	params.Set("oauth_signature", signature)
+	req.Header.Set("Authorization", makeAuthorizationHeader(params, false))
+}
+
+func TestVerifyEmptyPath(t *testing.T) {
+	req, err := testTransport.NewRequest(context.Background(), "GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	uri, err := baseStringURI(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if uri != "http://example.com/" {
+		t.Errorf("client base string URI\nhave %s\nwant %s", uri, "http://example.com/")
+	}
+
+	// The request as received by the server.
+	raw := "GET / HTTP/1.1\r\nHost: example.com\r\nAuthorization: " + req.Header.Get("Authorization") + "\r\n\r\n"
+	received, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	uri, err = baseStringURI(received, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if uri != "http://example.com/" {
+		t.Errorf("server base string URI\nhave %s\nwant %s", uri, "http://example.com/")
+	}
+
+	err = testVerifier.Verify(received)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// benchmarkRequest returns a request signed with its parameters split
+// between the query and form body, and the form body to send with it.
+func benchmarkRequest(tb testing.TB) (*http.Request, string) {
+	query := url.Values{}
+	form := url.Values{}
+	params := testParameters()
+	for k, vs := range benchmarkParameters() {
+		if _, ok := params[k]; ok {
+			continue
+		}
+
+		if len(query) <= len(form) {
+			query[k] = vs
+		} else {
+			form[k] = vs
+		}
+	}
+
+	body := form.Encode()
+	req, err := http.NewRequest("POST", "http://photos.example.net/photos?"+query.Encode(), strings.NewReader(body))
+	if err != nil {
+		tb.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	base, err := signatureBase(req, params, nil)
+	if err != nil {
+		tb.Fatalf("unexpected error %v", err)
+	}
+
+	signature, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+	if err != nil {
+		tb.Fatalf("unexpected error %v", err)
+	}
+
+	params.Set("oauth_signature", signature)
+	req.Header.Set("Authorization", makeAuthorizationHeader(params, false))
+
+	return req, body
+}
+
+var benchmarkVerifier = &Verifier{
+	ConsumerSecret: testVerifier.ConsumerSecret,
+	TokenSecret:    testVerifier.TokenSecret,
+	SingleLocation: true,
+}
+
+// multiPassVerify verifies the request as Verify did before the parameters
+// were collected in a single pass. The body is buffered and parsed by
+// ParseForm on a copy of the request, the Authorization header is parsed
+// again to check the parameter locations and the parameters are normalized
+// by naiveNormalizeParameters.
+func multiPassVerify(req *http.Request) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	r := cloneRequest(req)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Form = nil
+	r.PostForm = nil
+
+	params, err := parseAuthorizationHeader(r, nil)
+	if err != nil {
+		return err
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		return err
+	}
+
+	for k, vs := range r.Form {
+		params[k] = append(params[k], vs...)
+	}
+
+	header, err := parseAuthorizationHeader(r, nil)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, values := range []url.Values{header, r.URL.Query(), r.PostForm} {
+		if hasProtocolParameters(values) {
+			n++
+		}
+	}
+
+	if n > 1 {
+		return ErrMixedParameterLocations
+	}
+
+	signature := params.Get("oauth_signature")
+	params.Del("oauth_signature")
+
+	uri, err := baseStringURI(r, nil)
+	if err != nil {
+		return err
+	}
+
+	base := strings.ToUpper(r.Method) + "&" + encode(uri) + "&" + encode(naiveNormalizeParameters(params))
+	expected, err := sign(base, "kd94hf93k423kf44&pfkkdhi9sl3r4s00")
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func TestVerifyMultiPass(t *testing.T) {
+	var tests = []struct {
+		// in
+		body string
+		// out
+		err error
+	}{
+		{"", nil},
+		{"p0=tampered", ErrInvalidSignature},
+		{"oauth_callback=oob", ErrMixedParameterLocations},
+	}
+
+	for i, tt := range tests {
+		req, body := benchmarkRequest(t)
+		if tt.body != "" {
+			body = tt.body
+		}
+
+		for _, verify := range []func(*http.Request) error{benchmarkVerifier.Verify, multiPassVerify} {
+			req.Body = ioutil.NopCloser(strings.NewReader(body))
+			err := verify(req)
+			if err != tt.err {
+				t.Errorf("%d. verify\nhave %v\nwant %v", i, err, tt.err)
+			}
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	req, body := benchmarkRequest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		err := benchmarkVerifier.Verify(req)
+		if err != nil {
+			b.Fatalf("unexpected error %v", err)
+		}
+	}
+}
+
+// BenchmarkVerifyMultiPass verifies the request with the implementation that
+// preceded the single pass.
+func BenchmarkVerifyMultiPass(b *testing.B) {
+	req, body := benchmarkRequest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		err := multiPassVerify(req)
+		if err != nil {
+			b.Fatalf("unexpected error %v", err)
+		}
+	}
+}
+
+func TestVerifyComponents(t *testing.T) {
+	uri := "https://photos.example.net/photos?size=original"
+	req, err := http.NewRequest("POST", uri, strings.NewReader("file=vacation.jpg"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = testTransport.Sign(req, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tests = []struct {
+		// in
+		method string
+		rawurl string
+		host   string
+		body   string
+
+		// out
+		err error
+	}{
+		{"POST", uri, "", "file=vacation.jpg", nil},
+		{"POST", "https://internal.example.net/photos?size=original", "photos.example.net", "file=vacation.jpg", nil},
+		{"POST", uri, "", "file=vacation.png", ErrInvalidSignature},
+		{"POST", "http://photos.example.net/photos?size=original", "", "file=vacation.jpg", ErrInsecureTransport},
+	}
+
+	for i, tt := range tests {
+		header := http.Header{}
+		header.Set("Authorization", req.Header.Get("Authorization"))
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.host != "" {
+			header.Set("Host", tt.host)
+		}
+
+		v := *testVerifier
+		v.RequireTLS = true
+		err = v.VerifyComponents(tt.method, tt.rawurl, header, []byte(tt.body))
+		if err != tt.err {
+			t.Errorf("%d. VerifyComponents\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+// memoryNonceStore is a NonceStore that remembers every nonce.
+type memoryNonceStore map[[3]string]bool
+
+func (s memoryNonceStore) Seen(consumerKey, nonce, timestamp string) (bool, error) {
+	key := [3]string{consumerKey, nonce, timestamp}
+	seen := s[key]
+	s[key] = true
+
+	return seen, nil
+}
+
+func TestVerifyNonces(t *testing.T) {
+	var tests = []struct {
+		// in
+		consumerKey string
+		nonce       string
+
+		// out
+		err error
+	}{
+		{"dpf43f3p2l4k3l03", "kllo9940pd9333jh", nil},
+		{"dpf43f3p2l4k3l03", "kllo9940pd9333jh", ErrNonceReused},
+		{"9djdj82h48djs9d2", "kllo9940pd9333jh", nil},
+		{"9djdj82h48djs9d2", "kllo9940pd9333jh", ErrNonceReused},
+		{"dpf43f3p2l4k3l03", "wIjqoS", nil},
+	}
+
+	v := *testVerifier
+	v.Nonces = memoryNonceStore{}
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		params := testParameters()
+		params.Set("oauth_consumer_key", tt.consumerKey)
+		params.Set("oauth_nonce", tt.nonce)
+		signHeader(t, req, params)
+
+		err = v.Verify(req)
+		if err != tt.err {
+			t.Errorf("%d. Verify\nhave %v\nwant %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyNoncesInvalidSignature(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://photos.example.net/photos", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	signHeader(t, req, testParameters())
+
+	forged, err := http.NewRequest("GET", "http://photos.example.net/photos?size=original", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	forged.Header.Set("Authorization", req.Header.Get("Authorization"))
+
+	v := *testVerifier
+	v.Nonces = memoryNonceStore{}
+	err = v.Verify(forged)
+	if err != ErrInvalidSignature {
+		t.Errorf("forged Verify\nhave %v\nwant %v", err, ErrInvalidSignature)
+	}
+
+	// The nonce of the forged request is not recorded.
+	err = v.Verify(req)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}